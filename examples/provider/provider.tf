@@ -0,0 +1,26 @@
+terraform {
+  required_providers {
+    toolbox = {
+      source = "EnterpriseDB/toolbox"
+    }
+  }
+}
+
+# Every toolbox_external resource runs its programs from the scripts directory,
+# is updated in place and gets the region, unless it sets its own values.
+provider "toolbox" {
+  working_dir = "${path.module}/scripts"
+  update      = true
+
+  environment = {
+    ANSIBLE_STDOUT_CALLBACK = "json"
+  }
+  query = {
+    region = "eu-west-1"
+  }
+
+  timeouts {
+    create = "10m"
+    delete = "5m"
+  }
+}
@@ -0,0 +1,163 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+)
+
+// externalProgramSubsystem is the logging subsystem of the output streamed from the program while it runs.
+const externalProgramSubsystem = "external_program"
+
+// maxLogLineBytes is how long a line of output can grow before it is logged without waiting for its end.
+const maxLogLineBytes = 64 * 1024
+
+// defaultCaptureMaxBytes is how much of the program's stderr is kept in the state when capture_max_bytes is not set.
+const defaultCaptureMaxBytes = 16 * 1024
+
+// maxStderrBytes is how much of the program's stderr is kept for the diagnostics when the program fails.
+const maxStderrBytes = 64 * 1024
+
+// tailBuffer is an io.Writer which keeps the last max bytes written to it, so a chatty program cannot exhaust the
+// memory of the provider.
+type tailBuffer struct {
+	max int
+	buf []byte
+	// truncated is set once the start of the output was dropped.
+	truncated bool
+}
+
+func newTailBuffer(max int) *tailBuffer {
+	return &tailBuffer{max: max}
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	if len(p) >= b.max {
+		b.truncated = b.truncated || len(b.buf) > 0 || len(p) > b.max
+		b.buf = append(b.buf[:0], p[len(p)-b.max:]...)
+		return n, nil
+	}
+	if overflow := len(b.buf) + len(p) - b.max; overflow > 0 {
+		b.truncated = true
+		b.buf = append(b.buf[:0], b.buf[overflow:]...)
+	}
+	b.buf = append(b.buf, p...)
+	return n, nil
+}
+
+// Text returns at most the last max bytes written with the secrets redacted. The whole buffer is redacted before it
+// is cut, so no part of a secret is left at the cut, and the cut falls at the start of a UTF-8 character.
+func (b *tailBuffer) Text(max int, secrets []string) string {
+	text := redact(string(b.buf), secrets)
+	if b.truncated {
+		// The dropped output may have ended with the start of a secret, whose end is left unredacted
+		if drop := longestSecret(secrets); drop < len(text) {
+			text = text[drop:]
+		} else {
+			text = ""
+		}
+	}
+	if len(text) > max {
+		text = text[len(text)-max:]
+	}
+	for len(text) > 0 && !utf8.RuneStart(text[0]) {
+		text = text[1:]
+	}
+	return text
+}
+
+// longestSecret returns the length of the longest secret.
+func longestSecret(secrets []string) int {
+	longest := 0
+	for _, secret := range secrets {
+		if len(secret) > longest {
+			longest = len(secret)
+		}
+	}
+	return longest
+}
+
+// logWriter is an io.Writer which logs every line of the program's output in the external program subsystem as
+// soon as it is written, so the progress of long running programs can be followed in the Terraform logs. The
+// secrets are redacted from every entry, and a line too long to wait for its end is never cut within a secret.
+type logWriter struct {
+	ctx     context.Context
+	stream  string
+	secrets []string
+	buf     []byte
+}
+
+func newLogWriter(ctx context.Context, stream string, secrets []string) *logWriter {
+	return &logWriter{ctx: ctx, stream: stream, secrets: secrets}
+}
+
+func (w *logWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		end := bytes.IndexByte(w.buf, '\n')
+		if end < 0 {
+			break
+		}
+		w.log(w.buf[:end])
+		w.buf = w.buf[end+1:]
+	}
+	if len(w.buf) >= maxLogLineBytes {
+		// The end of the output is kept for the next entry when it can be the start of a secret or of a character
+		if cut := cutOutsideSecrets(w.buf, w.secrets); cut > 0 {
+			w.log(w.buf[:cut])
+			w.buf = w.buf[cut:]
+		}
+	}
+	return len(p), nil
+}
+
+// Flush logs the output which was written after the last line break.
+func (w *logWriter) Flush() {
+	if len(w.buf) > 0 {
+		w.log(w.buf)
+	}
+	w.buf = nil
+}
+
+func (w *logWriter) log(line []byte) {
+	tflog.SubsystemInfo(w.ctx, externalProgramSubsystem, redact(strings.TrimSuffix(string(line), "\r"), w.secrets), map[string]interface{}{
+		"stream": w.stream,
+	})
+}
+
+// cutOutsideSecrets returns the last position at which text can be cut without cutting a UTF-8 character or a
+// secret, including a secret which the end of text is the start of.
+func cutOutsideSecrets(text []byte, secrets []string) int {
+	cut := len(text)
+	for moved := true; moved; {
+		moved = false
+		for _, secret := range secrets {
+			for start := cut - len(secret) + 1; start < cut; start++ {
+				if start < 0 {
+					continue
+				}
+				end := start + len(secret)
+				if end > len(text) {
+					end = len(text)
+				}
+				if string(text[start:end]) == secret[:end-start] {
+					cut, moved = start, true
+					break
+				}
+			}
+		}
+	}
+	// The last character before the cut is kept whole, even when the rest of it was not written yet
+	start := cut
+	for start > 0 && cut-start < utf8.UTFMax && !utf8.RuneStart(text[start-1]) {
+		start--
+	}
+	if start > 0 && !utf8.FullRune(text[start-1:cut]) {
+		cut = start - 1
+	}
+	return cut
+}
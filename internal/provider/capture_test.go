@@ -0,0 +1,165 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+	"github.com/hashicorp/terraform-plugin-log/tflogtest"
+)
+
+func TestTailBuffer_Text(t *testing.T) {
+	testCases := map[string]struct {
+		max     int
+		writes  []string
+		textMax int
+		secrets []string
+		want    string
+	}{
+		"short": {
+			max:     16,
+			writes:  []string{"some ", "output"},
+			textMax: 16,
+			want:    "some output",
+		},
+		"tail": {
+			max:     8,
+			writes:  []string{"first ", "second ", "third"},
+			textMax: 8,
+			want:    "nd third",
+		},
+		"redacted before the cut": {
+			// The cut would leave "ecret" of the secret visible if it was made before redacting
+			max:     32,
+			writes:  []string{"the secret is here"},
+			textMax: 13,
+			secrets: []string{"secret"},
+			want:    "e *** is here",
+		},
+		"secret cut by the buffer": {
+			// The buffer dropped the start of the secret, its end is dropped with it
+			max:     12,
+			writes:  []string{"the secret is here"},
+			textMax: 12,
+			secrets: []string{"secret"},
+			want:    "s here",
+		},
+		"rune boundary": {
+			max:     32,
+			writes:  []string{"prix: 10€"},
+			textMax: 2,
+			want:    "",
+		},
+		"rune cut by the buffer": {
+			max:     4,
+			writes:  []string{"10€ ok"},
+			textMax: 4,
+			want:    " ok",
+		},
+	}
+
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			buffer := newTailBuffer(testCase.max)
+			for _, write := range testCase.writes {
+				if _, err := buffer.Write([]byte(write)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			text := buffer.Text(testCase.textMax, testCase.secrets)
+			if text != testCase.want {
+				t.Errorf("text is %q; want %q", text, testCase.want)
+			}
+			if !utf8.ValidString(text) {
+				t.Errorf("text %q is not valid UTF-8", text)
+			}
+			for _, secret := range testCase.secrets {
+				for end := 2; end <= len(secret); end++ {
+					if strings.Contains(text, secret[len(secret)-end:]) {
+						t.Errorf("text %q holds the end of the secret %q", text, secret)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestLogWriter(t *testing.T) {
+	long := strings.Repeat("x", maxLogLineBytes-4)
+
+	testCases := map[string]struct {
+		writes  []string
+		secrets []string
+		want    []string
+	}{
+		"lines": {
+			writes: []string{"first\nsec", "ond\r\n", "third"},
+			want:   []string{"first", "second", "third"},
+		},
+		"masked": {
+			writes:  []string{"the password is hun", "ter2\n"},
+			secrets: []string{"hunter2"},
+			want:    []string{"the password is ***"},
+		},
+		"long line": {
+			// The line is logged before its end once it is too long
+			writes: []string{long, "1234", "5678", "\n"},
+			want:   []string{long + "1234", "5678"},
+		},
+		"secret across long line": {
+			// The start of the secret is kept with the rest of it rather than logged once the line is too long
+			writes:  []string{long, "abc-hun", "ter2-def\n"},
+			secrets: []string{"hunter2"},
+			want:    []string{long + "abc-", "***-def"},
+		},
+		"character across long line": {
+			writes: []string{long, "ab\xe2\x82", "\xacc\n"},
+			want:   []string{long + "ab", "€c"},
+		},
+		"final flush": {
+			writes:  []string{"done\nno line break hunter2"},
+			secrets: []string{"hunter2"},
+			want:    []string{"done", "no line break ***"},
+		},
+	}
+
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			var output bytes.Buffer
+			ctx := tflogtest.RootLogger(context.Background(), &output)
+			ctx = tflog.NewSubsystem(ctx, externalProgramSubsystem)
+
+			w := newLogWriter(ctx, "stdout", testCase.secrets)
+			for _, write := range testCase.writes {
+				if _, err := w.Write([]byte(write)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			w.Flush()
+
+			entries, err := tflogtest.MultilineJSONDecode(&output)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var messages []string
+			for _, entry := range entries {
+				if entry["@module"] != "provider."+externalProgramSubsystem || entry["stream"] != "stdout" {
+					t.Errorf("unexpected log entry: %v", entry)
+				}
+				message, _ := entry["@message"].(string)
+				messages = append(messages, message)
+			}
+			if len(messages) != len(testCase.want) {
+				t.Fatalf("logged %d entries; want %d: %q", len(messages), len(testCase.want), messages)
+			}
+			for index, message := range messages {
+				if message != testCase.want[index] {
+					t.Errorf("entry %d is %.40q (%d bytes); want %.40q (%d bytes)", index, message, len(message), testCase.want[index], len(testCase.want[index]))
+				}
+			}
+		})
+	}
+}
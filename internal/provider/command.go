@@ -0,0 +1,146 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os/exec"
+	"time"
+
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+)
+
+// externalCommand is everything needed to run the program of a stage, which can be run more than once when the
+// stage is retried.
+type externalCommand struct {
+	Program     []string
+	Dir         string
+	Env         []string
+	Stdin       []byte
+	Stage       string
+	Timeout     time.Duration
+	GracePeriod time.Duration
+	// StderrBytes is how much of the end of stderr is kept.
+	StderrBytes int
+	LogStdout   bool
+	// Secrets are masked in the logs of the output.
+	Secrets []string
+}
+
+// externalRun is the outcome of a single run of the program.
+type externalRun struct {
+	// Command is what was run, including the JSON object passed to the program on stdin.
+	Command   externalCommand
+	Attempt   int
+	Cmd       *exec.Cmd
+	Stdout    []byte
+	Stderr    *tailBuffer
+	Err       error
+	TimedOut  bool
+	StartedAt time.Time
+	Duration  time.Duration
+}
+
+// run starts the program and waits for it to exit. When the timeout is reached, the program's process group is
+// sent SIGTERM, or SIGINT when Terraform cancels the operation, and whatever is still running after the grace
+// period is killed.
+func (c externalCommand) run(ctx context.Context, attempt int) externalRun {
+	runCtx := ctx
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		runCtx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+
+	// Setup the command to run
+	cmd := exec.CommandContext(runCtx, c.Program[0], c.Program[1:]...)
+	cmd.Dir = c.Dir
+	cmd.Env = c.Env
+	cmd.Stdin = bytes.NewReader(c.Stdin)
+	group := newProcessGroup(cmd)
+	defer group.close()
+
+	// The program runs in its own process group, so the signals Terraform receives do not reach it. When the stage
+	// times out the group is sent SIGTERM, and when Terraform cancels the operation it is sent SIGINT, as a Ctrl-C
+	// would have done. Either way the group is given the grace period to exit.
+	var killDeadline time.Time
+	timedOut := false
+	cmd.Cancel = func() error {
+		killDeadline = time.Now().Add(c.GracePeriod)
+		if ctx.Err() != nil {
+			tflog.Warn(ctx, "External program cancelled, sending SIGINT", map[string]interface{}{
+				"program": cmd.String(), "stage": c.Stage, "attempt": attempt, "grace_period": c.GracePeriod.String(),
+			})
+			return group.interrupt()
+		}
+		timedOut = true
+		tflog.Warn(ctx, "External program timed out, sending SIGTERM", map[string]interface{}{
+			"program": cmd.String(), "stage": c.Stage, "attempt": attempt,
+			"timeout": c.Timeout.String(), "grace_period": c.GracePeriod.String(),
+		})
+		return group.terminate()
+	}
+	// Processes started by the program can keep its stdout and stderr open after it exited, the pipes are closed
+	// after the grace period so they can not block the apply
+	cmd.WaitDelay = c.GracePeriod
+
+	// The output is logged while the program runs so long runs can be followed with TF_LOG=INFO
+	logCtx := tflog.NewSubsystem(ctx, externalProgramSubsystem)
+	logCtx = tflog.SubsystemMaskLogStrings(logCtx, externalProgramSubsystem, c.Secrets...)
+	logCtx = tflog.SubsystemSetField(logCtx, externalProgramSubsystem, "stage", c.Stage)
+	logCtx = tflog.SubsystemSetField(logCtx, externalProgramSubsystem, "program", c.Program[0])
+	logCtx = tflog.SubsystemSetField(logCtx, externalProgramSubsystem, "attempt", attempt)
+
+	// Only the end of stderr is kept, which is where programs usually report why they failed
+	stderr := newTailBuffer(c.StderrBytes)
+	stderrLog := newLogWriter(logCtx, "stderr", c.Secrets)
+	cmd.Stderr = io.MultiWriter(stderr, stderrLog)
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	stdoutLog := newLogWriter(logCtx, "stdout", c.Secrets)
+	if c.LogStdout {
+		cmd.Stdout = io.MultiWriter(&stdout, stdoutLog)
+	}
+
+	tflog.Trace(ctx, "Executing external program", map[string]interface{}{"program": cmd.String(), "attempt": attempt})
+
+	startedAt := time.Now()
+	err := cmd.Start()
+	if err == nil {
+		if groupErr := group.started(); groupErr != nil {
+			tflog.Warn(ctx, "Failed to track the processes started by the external program, only the program itself will be stopped", map[string]interface{}{
+				"program": cmd.String(), "error": groupErr.Error(),
+			})
+		}
+		err = cmd.Wait()
+	}
+	duration := time.Since(startedAt)
+	stderrLog.Flush()
+	stdoutLog.Flush()
+
+	if !killDeadline.IsZero() {
+		// Anything left in the process group after the grace period is killed
+		if killErr := group.killAfter(killDeadline); killErr != nil {
+			tflog.Warn(ctx, "Failed to kill external program process group", map[string]interface{}{"program": cmd.String(), "error": killErr.Error()})
+		}
+	} else if errors.Is(err, exec.ErrWaitDelay) {
+		// The program succeeded, only the processes it left in the background still held its output
+		tflog.Warn(ctx, "External program exited but its output was held open, closed it after the grace period", map[string]interface{}{
+			"program": cmd.String(), "stage": c.Stage, "grace_period": c.GracePeriod.String(),
+		})
+		err = nil
+	}
+
+	return externalRun{
+		Command:   c,
+		Attempt:   attempt,
+		Cmd:       cmd,
+		Stdout:    stdout.Bytes(),
+		Stderr:    stderr,
+		Err:       err,
+		TimedOut:  err != nil && timedOut,
+		StartedAt: startedAt,
+		Duration:  duration,
+	}
+}
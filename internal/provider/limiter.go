@@ -0,0 +1,94 @@
+package provider
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+)
+
+// programLimiter coordinates the programs run by the resources of a provider: it limits how many of them run at
+// once and runs the programs of the resources sharing a lock name one at a time.
+type programLimiter struct {
+	// slots holds a value for every running program, it is nil when the number of programs is not limited.
+	slots chan struct{}
+
+	mu    sync.Mutex
+	locks map[string]chan struct{}
+}
+
+// newProgramLimiter returns a limiter running at most maxConcurrent programs at once, or any number of them when
+// maxConcurrent is zero.
+func newProgramLimiter(maxConcurrent int) *programLimiter {
+	limiter := &programLimiter{locks: map[string]chan struct{}{}}
+	if maxConcurrent > 0 {
+		limiter.slots = make(chan struct{}, maxConcurrent)
+	}
+	return limiter
+}
+
+// acquire waits until the lock of the name, when it is not empty, and a slot are free, and returns the function
+// releasing them. The time spent waiting is logged. It fails when ctx is done before then.
+func (l *programLimiter) acquire(ctx context.Context, lockName string) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+
+	var held []chan struct{}
+	release := func() {
+		for i := len(held) - 1; i >= 0; i-- {
+			<-held[i]
+		}
+	}
+
+	// The lock is taken before the slot so a resource waiting for its lock does not keep other programs waiting
+	var channels []chan struct{}
+	if lockName != "" {
+		channels = append(channels, l.lock(lockName))
+	}
+	if l.slots != nil {
+		channels = append(channels, l.slots)
+	}
+
+	start := time.Now()
+	waited := false
+	for _, channel := range channels {
+		select {
+		case channel <- struct{}{}:
+			held = append(held, channel)
+			continue
+		default:
+		}
+
+		waited = true
+		tflog.Debug(ctx, "Waiting to run external program", map[string]interface{}{"lock_name": lockName})
+		select {
+		case channel <- struct{}{}:
+			held = append(held, channel)
+		case <-ctx.Done():
+			release()
+			return nil, ctx.Err()
+		}
+	}
+
+	if waited {
+		tflog.Info(ctx, "Waited to run external program", map[string]interface{}{
+			"lock_name": lockName, "waited": time.Since(start).String(),
+		})
+	}
+	return release, nil
+}
+
+// lock returns the channel holding the lock of the name, which is shared by every resource of the provider.
+func (l *programLimiter) lock(name string) chan struct{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	lock, ok := l.locks[name]
+	if !ok {
+		lock = make(chan struct{}, 1)
+		l.locks[name] = lock
+	}
+	return lock
+}
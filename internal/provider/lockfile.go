@@ -0,0 +1,163 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/terraform-plugin-framework/diag"
+	"github.com/hashicorp/terraform-plugin-framework/path"
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+)
+
+// fileLockPollInterval is how often a held lock file is tried again.
+const fileLockPollInterval = 100 * time.Millisecond
+
+// fileLock is an exclusive lock on a file, which is shared with every other process locking the same file, such as
+// other Terraform runs on the same machine.
+type fileLock struct {
+	file *os.File
+}
+
+// fileLockTimeoutError is returned when the lock file is still held by another process after the wait timeout.
+type fileLockTimeoutError struct {
+	Path    string
+	Timeout time.Duration
+	// Holder is the process ID written in the lock file by the process holding it, empty when it is unknown.
+	Holder string
+}
+
+func (e *fileLockTimeoutError) Error() string {
+	holder := "another process"
+	if e.Holder != "" {
+		holder = "the process with PID " + e.Holder
+	}
+	return fmt.Sprintf("%s is still locked by %s after %s", e.Path, holder, e.Timeout)
+}
+
+// lockFile takes the lock of the lock file of the resource, waiting at most its lock timeout.
+func (m externalResourceModelV0) lockFile(ctx context.Context) (*fileLock, diag.Diagnostics) {
+	var diags diag.Diagnostics
+
+	var timeout time.Duration
+	if !m.LockTimeout.IsNull() {
+		var err error
+		timeout, err = time.ParseDuration(m.LockTimeout.ValueString())
+		if err != nil {
+			diags.AddAttributeError(path.Root("lock_timeout"),
+				"Invalid Lock Timeout",
+				fmt.Sprintf("The lock timeout could not be parsed: %s", err),
+			)
+			return nil, diags
+		}
+	}
+
+	lock, err := acquireFileLock(ctx, m.LockFile.ValueString(), timeout)
+	var timeoutErr *fileLockTimeoutError
+	switch {
+	case errors.As(err, &timeoutErr):
+		holder := "another process, which did not record its process ID"
+		if timeoutErr.Holder != "" {
+			holder = fmt.Sprintf("the process with PID %s", timeoutErr.Holder)
+		}
+		diags.AddAttributeError(path.Root("lock_file"),
+			"External Program Lock Timed Out",
+			fmt.Sprintf("The lock file %s was still held by %s after waiting %s, so the program did not run. ", timeoutErr.Path, holder, timeoutErr.Timeout)+
+				"Another Terraform run may be applying against the same hosts: wait for it to complete, or "+
+				"increase lock_timeout.",
+		)
+	case err != nil && ctx.Err() != nil:
+		diags.AddError(
+			"External Program Wait Cancelled",
+			fmt.Sprintf("The operation was cancelled while waiting for the lock file %s: %s", m.LockFile.ValueString(), err),
+		)
+	case err != nil:
+		diags.AddAttributeError(path.Root("lock_file"),
+			"External Program Lock Failed",
+			fmt.Sprintf("The lock file %s could not be locked: %s", m.LockFile.ValueString(), err),
+		)
+	}
+	return lock, diags
+}
+
+// acquireFileLock waits until it holds the exclusive lock of the file, which is created when it does not exist, and
+// writes the process ID of the provider into it so the processes waiting for the lock can tell who holds it. It
+// gives up after timeout when it is positive, and when ctx is done.
+func acquireFileLock(ctx context.Context, lockPath string, timeout time.Duration) (*fileLock, error) {
+	file, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	ticker := time.NewTicker(fileLockPollInterval)
+	defer ticker.Stop()
+
+	start := time.Now()
+	waited := false
+	for {
+		locked, err := tryLockFile(file)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		if locked {
+			break
+		}
+
+		if !waited {
+			waited = true
+			tflog.Debug(ctx, "Waiting for lock file", map[string]interface{}{"lock_file": lockPath, "holder": readFileLockHolder(file)})
+		}
+		select {
+		case <-ticker.C:
+		case <-deadline:
+			holder := readFileLockHolder(file)
+			file.Close()
+			return nil, &fileLockTimeoutError{Path: lockPath, Timeout: timeout, Holder: holder}
+		case <-ctx.Done():
+			file.Close()
+			return nil, ctx.Err()
+		}
+	}
+
+	if waited {
+		tflog.Info(ctx, "Waited for lock file", map[string]interface{}{"lock_file": lockPath, "waited": time.Since(start).String()})
+	}
+
+	// A failure to record the holder only makes the timeout diagnostics of the other processes less helpful
+	if err := file.Truncate(0); err == nil {
+		_, err = file.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+		if err != nil {
+			tflog.Warn(ctx, "Failed to write the process ID to the lock file", map[string]interface{}{"lock_file": lockPath, "error": err.Error()})
+		}
+	}
+	return &fileLock{file: file}, nil
+}
+
+// release clears the process ID from the lock file and releases the lock. The file is kept, as removing it would
+// let another process lock a new file of the same name while a third one still waits on the removed one.
+func (l *fileLock) release() error {
+	l.file.Truncate(0)
+	if err := unlockFile(l.file); err != nil {
+		l.file.Close()
+		return err
+	}
+	return l.file.Close()
+}
+
+// readFileLockHolder returns the process ID written in the lock file by the process holding it.
+func readFileLockHolder(file *os.File) string {
+	content := make([]byte, 32)
+	n, _ := file.ReadAt(content, 0)
+	return strings.TrimSpace(string(content[:n]))
+}
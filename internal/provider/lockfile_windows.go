@@ -0,0 +1,29 @@
+//go:build windows
+
+package provider
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// fileLockOffset is the offset of the byte locked in the lock file. Windows locks prevent other processes from
+// reading the locked bytes, so the byte is far beyond the process ID written at the start of the file.
+const fileLockOffset = 0x7fffffff
+
+// tryLockFile takes the exclusive lock of the file without waiting, and returns whether it got it.
+func tryLockFile(file *os.File) (bool, error) {
+	overlapped := &windows.Overlapped{OffsetHigh: fileLockOffset}
+	err := windows.LockFileEx(windows.Handle(file.Fd()), windows.LOCKFILE_EXCLUSIVE_LOCK|windows.LOCKFILE_FAIL_IMMEDIATELY, 0, 1, 0, overlapped)
+	if errors.Is(err, windows.ERROR_LOCK_VIOLATION) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func unlockFile(file *os.File) error {
+	overlapped := &windows.Overlapped{OffsetHigh: fileLockOffset}
+	return windows.UnlockFileEx(windows.Handle(file.Fd()), 0, 1, 0, overlapped)
+}
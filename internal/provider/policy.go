@@ -0,0 +1,229 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/hashicorp/terraform-plugin-framework/diag"
+	"github.com/hashicorp/terraform-plugin-framework/path"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+)
+
+// programPatternRegexpPrefix marks the patterns of allowed_programs and denied_programs which are regular
+// expressions rather than globs.
+const programPatternRegexpPrefix = "regexp:"
+
+// programAttributes are the attributes of the resource holding a program, which the execution policy of the
+// provider applies to.
+var programAttributes = []string{
+	"program", "create_program", "read_program", "update_program", "delete_program", "plan_program", "rollback_program",
+}
+
+// deniedEnvironment are the variables which change the code a program runs, such as the libraries its loader
+// injects or the scripts its interpreter runs on startup, so an allowed program could run anything with them.
+var deniedEnvironment = map[string]bool{
+	"PATH": true, "IFS": true, "ENV": true, "BASH_ENV": true, "SHELLOPTS": true, "BASHOPTS": true, "PS4": true,
+	"PROMPT_COMMAND": true, "GCONV_PATH": true,
+	"PYTHONPATH": true, "PYTHONHOME": true, "PYTHONSTARTUP": true, "PYTHONINSPECT": true,
+	"PERL5LIB": true, "PERLLIB": true, "PERL5OPT": true, "RUBYLIB": true, "RUBYOPT": true,
+	"NODE_OPTIONS": true, "NODE_PATH": true, "JAVA_TOOL_OPTIONS": true, "_JAVA_OPTIONS": true, "JDK_JAVA_OPTIONS": true,
+	"CLASSPATH": true, "LUA_INIT": true, "LUA_PATH": true, "LUA_CPATH": true,
+}
+
+// deniedEnvironmentPrefixes are the prefixes of the variables which are denied like deniedEnvironment: those of the
+// dynamic loaders and the functions exported by bash.
+var deniedEnvironmentPrefixes = []string{"LD_", "DYLD_", "BASH_FUNC_"}
+
+// policyEnabled returns whether the provider configuration restricts the programs the resources can run.
+func (d *toolboxProviderModel) policyEnabled() bool {
+	return d != nil && (!d.AllowedPrograms.IsNull() || !d.DeniedPrograms.IsNull() || !d.AllowedArguments.IsNull())
+}
+
+// checkEnvironment denies the variables of deniedEnvironment in `environment` and `sensitive_environment` of the
+// resource while the provider configuration restricts the programs, as they would let an allowed program run
+// anything. The variables set by the provider configuration and inherited from Terraform are not checked, they are
+// as trusted as the policy itself. Maps which are not known yet are not checked.
+func (d *toolboxProviderModel) checkEnvironment(m externalResourceModelV0) diag.Diagnostics {
+	var diags diag.Diagnostics
+	if !d.policyEnabled() {
+		return diags
+	}
+	for _, environment := range []struct {
+		attribute string
+		variables types.Map
+	}{
+		{"environment", m.Environment},
+		{"sensitive_environment", m.SensitiveEnvironment},
+	} {
+		if environment.variables.IsUnknown() {
+			continue
+		}
+		for name := range environment.variables.Elements() {
+			if !deniedVariable(name) {
+				continue
+			}
+			diags.AddAttributeError(path.Root(environment.attribute).AtMapKey(name),
+				"External Program Environment Not Allowed",
+				fmt.Sprintf("The variable %s can change the code the program runs, which the execution policy of the provider configuration does not allow. "+
+					"Set it in the environment of the provider configuration instead.", name),
+			)
+		}
+	}
+	return diags
+}
+
+// deniedVariable returns whether the variable is denied by checkEnvironment. Names are compared regardless of their
+// case, as they are on Windows.
+func deniedVariable(name string) bool {
+	name = strings.ToUpper(name)
+	if deniedEnvironment[name] {
+		return true
+	}
+	for _, prefix := range deniedEnvironmentPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkProgram enforces the execution policy of the provider configuration on a program of the resource: the path
+// it resolves to from the working directory must match `allowed_programs` when it is set and must not match
+// `denied_programs`, and every argument must match `allowed_arguments`. The working directory of the resource
+// defaults to the one of the provider configuration. Programs, working directories and policies which are not known
+// yet are not checked.
+func (d *toolboxProviderModel) checkProgram(ctx context.Context, program types.List, workingDir types.String, programPath path.Path) diag.Diagnostics {
+	var diags diag.Diagnostics
+	if d == nil {
+		return diags
+	}
+	args, known := programArgs(program)
+	if !known || len(args) == 0 {
+		return diags
+	}
+	if workingDir.IsNull() {
+		workingDir = d.WorkingDir
+	}
+	if workingDir.IsUnknown() && relativeProgram(args[0]) {
+		return diags
+	}
+	resolved := resolveProgram(args[0], workingDir.ValueString())
+
+	for _, policy := range []struct {
+		attribute string
+		patterns  types.List
+		allow     bool
+	}{
+		{"allowed_programs", d.AllowedPrograms, true},
+		{"denied_programs", d.DeniedPrograms, false},
+	} {
+		if policy.patterns.IsNull() || policy.patterns.IsUnknown() {
+			continue
+		}
+		var patterns []string
+		diags.Append(policy.patterns.ElementsAs(ctx, &patterns, false)...)
+		if diags.HasError() {
+			return diags
+		}
+		matched, pattern, err := matchProgram(patterns, resolved)
+		if err != nil {
+			diags.AddAttributeError(programPath,
+				"Invalid Program Policy",
+				fmt.Sprintf("The provider was configured with an invalid pattern in %s: %s", policy.attribute, err),
+			)
+			return diags
+		}
+		if policy.allow && !matched {
+			diags.AddAttributeError(programPath,
+				"External Program Not Allowed",
+				fmt.Sprintf("The program %q resolves to %s, which matches none of the allowed_programs of the provider configuration.", args[0], resolved),
+			)
+		}
+		if !policy.allow && matched {
+			diags.AddAttributeError(programPath,
+				"External Program Denied",
+				fmt.Sprintf("The program %q resolves to %s, which matches the pattern %q of the denied_programs of the provider configuration.", args[0], resolved, pattern),
+			)
+		}
+	}
+
+	if !d.AllowedArguments.IsNull() && !d.AllowedArguments.IsUnknown() {
+		expression, err := regexp.Compile("^(?:" + d.AllowedArguments.ValueString() + ")$")
+		if err != nil {
+			diags.AddAttributeError(programPath,
+				"Invalid Program Policy",
+				fmt.Sprintf("The provider was configured with an invalid allowed_arguments: %s", err),
+			)
+			return diags
+		}
+		for index, arg := range args[1:] {
+			if !expression.MatchString(arg) {
+				diags.AddAttributeError(programPath.AtListIndex(index+1),
+					"External Program Argument Not Allowed",
+					fmt.Sprintf("The argument %q of the program %q does not match the allowed_arguments of the provider configuration: %s", arg, args[0], d.AllowedArguments.ValueString()),
+				)
+			}
+		}
+	}
+	return diags
+}
+
+// resolveProgram returns the path the program runs from in the working directory as exec.LookPath finds it. A
+// program which can not be found yet, for example because an earlier resource creates it, is checked by its absolute
+// path when it has one, or by its name.
+func resolveProgram(name string, workingDir string) string {
+	name = programLocation(name, workingDir)
+	if resolved, err := exec.LookPath(name); err == nil {
+		name = resolved
+	}
+	if strings.ContainsRune(name, filepath.Separator) || strings.ContainsRune(name, '/') {
+		if absolute, err := filepath.Abs(name); err == nil {
+			return absolute
+		}
+	}
+	return name
+}
+
+// programLocation returns the program relative to the working directory of the process running it.
+func programLocation(name string, workingDir string) string {
+	if workingDir == "" || !relativeProgram(name) {
+		return name
+	}
+	return filepath.Join(workingDir, name)
+}
+
+// relativeProgram reports whether exec.Cmd runs the program relative to its working directory: a name without a
+// separator is looked up in PATH instead.
+func relativeProgram(name string) bool {
+	return !filepath.IsAbs(name) && (strings.ContainsRune(name, filepath.Separator) || strings.ContainsRune(name, '/'))
+}
+
+// matchProgram returns the first pattern matching the whole program path. Patterns starting with `regexp:` are
+// regular expressions, the others are globs.
+func matchProgram(patterns []string, program string) (bool, string, error) {
+	for _, pattern := range patterns {
+		matched, err := matchProgramPattern(pattern, program)
+		if err != nil {
+			return false, "", fmt.Errorf("%q: %w", pattern, err)
+		}
+		if matched {
+			return true, pattern, nil
+		}
+	}
+	return false, "", nil
+}
+
+func matchProgramPattern(pattern string, program string) (bool, error) {
+	if expression, ok := strings.CutPrefix(pattern, programPatternRegexpPrefix); ok {
+		compiled, err := regexp.Compile("^(?:" + expression + ")$")
+		if err != nil {
+			return false, err
+		}
+		return compiled.MatchString(program), nil
+	}
+	return filepath.Match(pattern, program)
+}
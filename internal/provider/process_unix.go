@@ -0,0 +1,67 @@
+//go:build !windows
+
+package provider
+
+import (
+	"errors"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// processGroup is the process group the program runs in, along with every process it started.
+type processGroup struct {
+	cmd *exec.Cmd
+}
+
+// newProcessGroup starts the program in its own process group so it can be signalled along with its children.
+func newProcessGroup(cmd *exec.Cmd) *processGroup {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	return &processGroup{cmd: cmd}
+}
+
+// started is called once the program started. The process group is created along with the program.
+func (g *processGroup) started() error {
+	return nil
+}
+
+// close releases the process group once the program exited. The processes it left in the background keep running.
+func (g *processGroup) close() {}
+
+// terminate sends SIGTERM to every process in the program's process group.
+func (g *processGroup) terminate() error {
+	return g.signal(syscall.SIGTERM)
+}
+
+// interrupt sends SIGINT to every process in the program's process group, as a Ctrl-C in the terminal running
+// Terraform would have done if the program was not in its own group.
+func (g *processGroup) interrupt() error {
+	return g.signal(syscall.SIGINT)
+}
+
+// killAfter waits until every process in the program's process group has exited or the deadline passed, then
+// sends SIGKILL to whatever is left of the group.
+func (g *processGroup) killAfter(deadline time.Time) error {
+	if g.cmd.Process == nil {
+		return nil
+	}
+	for time.Now().Before(deadline) {
+		// Signal 0 only checks whether any process of the group is still alive
+		if err := syscall.Kill(-g.cmd.Process.Pid, 0); err != nil {
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return g.signal(syscall.SIGKILL)
+}
+
+func (g *processGroup) signal(signal syscall.Signal) error {
+	if g.cmd.Process == nil {
+		return nil
+	}
+	err := syscall.Kill(-g.cmd.Process.Pid, signal)
+	if errors.Is(err, syscall.ESRCH) {
+		return nil
+	}
+	return err
+}
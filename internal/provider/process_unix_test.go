@@ -0,0 +1,71 @@
+//go:build !windows
+
+package provider
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestExternalCommand_ProcessTree(t *testing.T) {
+	// The wrapper shell exits on SIGTERM and SIGINT, but leaves behind a grandchild which ignores them and keeps
+	// writing to the heartbeat file, along with the output of the wrapper
+	const wrapper = `(trap "" TERM INT; while :; do echo . >> "$1"; sleep 0.1; done) & wait`
+
+	testCases := map[string]struct {
+		timeout time.Duration
+		cancel  time.Duration
+	}{
+		"timeout": {
+			timeout: 500 * time.Millisecond,
+		},
+		"cancellation": {
+			cancel: 500 * time.Millisecond,
+		},
+	}
+
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			heartbeat := filepath.Join(t.TempDir(), "heartbeat")
+
+			ctx := context.Background()
+			if testCase.cancel > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, testCase.cancel)
+				defer cancel()
+			}
+			command := externalCommand{
+				Program:     []string{"sh", "-c", wrapper, "sh", heartbeat},
+				Env:         os.Environ(),
+				Stage:       "create",
+				Timeout:     testCase.timeout,
+				GracePeriod: 300 * time.Millisecond,
+				StderrBytes: maxStderrBytes,
+			}
+			run := command.run(ctx, 1)
+			if run.Err == nil {
+				t.Fatal("the program was not stopped")
+			}
+			if run.TimedOut != (testCase.timeout > 0) {
+				t.Errorf("timed out is %t; want %t", run.TimedOut, testCase.timeout > 0)
+			}
+
+			// The grandchild was killed along with the wrapper, so the heartbeat stopped
+			before, err := os.ReadFile(heartbeat)
+			if err != nil {
+				t.Fatal(err)
+			}
+			time.Sleep(500 * time.Millisecond)
+			after, err := os.ReadFile(heartbeat)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(after) != len(before) {
+				t.Fatalf("the grandchild of the program is still running after the grace period: %d heartbeats, then %d", len(before), len(after))
+			}
+		})
+	}
+}
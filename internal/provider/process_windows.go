@@ -0,0 +1,126 @@
+//go:build windows
+
+package provider
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// processGroup is the job object the program runs in, which every process it starts is assigned to as well.
+// Windows has no process groups which can be signalled along with their children, so the whole job is terminated
+// instead. job is 0 when the job object could not be created, only the program is killed then.
+type processGroup struct {
+	cmd *exec.Cmd
+	// mu guards job, as the program can be stopped by the cancellation of the stage while it is being assigned.
+	mu  sync.Mutex
+	job windows.Handle
+}
+
+// newProcessGroup creates the job object of the program and starts it in its own console process group, so it
+// does not receive the console signals of the provider.
+func newProcessGroup(cmd *exec.Cmd) *processGroup {
+	cmd.SysProcAttr = &syscall.SysProcAttr{CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP}
+
+	job, err := windows.CreateJobObject(nil, nil)
+	if err != nil {
+		return &processGroup{cmd: cmd}
+	}
+	// The processes of the job are killed if the provider exits while the program runs
+	if err := setKillOnJobClose(job, true); err != nil {
+		windows.CloseHandle(job)
+		return &processGroup{cmd: cmd}
+	}
+	return &processGroup{cmd: cmd, job: job}
+}
+
+// started assigns the program to the job object once it started. The processes it starts from then on belong to
+// the job too, but the ones it started before it was assigned, right after it started, do not. When the program can
+// not be assigned, the job object is released and only the program is killed.
+func (g *processGroup) started() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.job == 0 || g.cmd.Process == nil {
+		return nil
+	}
+	process, err := windows.OpenProcess(windows.PROCESS_SET_QUOTA|windows.PROCESS_TERMINATE, false, uint32(g.cmd.Process.Pid))
+	if err == nil {
+		err = windows.AssignProcessToJobObject(g.job, process)
+		windows.CloseHandle(process)
+	}
+	if err != nil {
+		g.release()
+	}
+	return err
+}
+
+// close releases the job object once the program exited. The processes it left in the background keep running, as
+// they do on other platforms.
+func (g *processGroup) close() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.release()
+}
+
+func (g *processGroup) release() {
+	if g.job == 0 {
+		return
+	}
+	setKillOnJobClose(g.job, false)
+	windows.CloseHandle(g.job)
+	g.job = 0
+}
+
+// terminate stops the program and every process it started. Windows has no equivalent of SIGTERM for console
+// programs, so they are killed straight away.
+func (g *processGroup) terminate() error {
+	return g.kill()
+}
+
+// interrupt stops the program and every process it started when Terraform cancels the operation. Like SIGTERM,
+// Windows has no equivalent of SIGINT which can be sent to another process group, so they are killed straight away.
+func (g *processGroup) interrupt() error {
+	return g.kill()
+}
+
+// killAfter kills whatever is left of the program and the processes it started. They were already killed by
+// terminate, so there is nothing to wait for.
+func (g *processGroup) killAfter(_ time.Time) error {
+	return g.kill()
+}
+
+// kill terminates the job, and the program itself in case it was not assigned to the job yet.
+func (g *processGroup) kill() error {
+	if g.cmd.Process == nil {
+		return nil
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.job != 0 {
+		if err := windows.TerminateJobObject(g.job, 1); err != nil {
+			return err
+		}
+	}
+	err := g.cmd.Process.Kill()
+	if errors.Is(err, os.ErrProcessDone) {
+		return nil
+	}
+	return err
+}
+
+// setKillOnJobClose sets whether the processes of the job are killed when its last handle is closed.
+func setKillOnJobClose(job windows.Handle, kill bool) error {
+	var info windows.JOBOBJECT_EXTENDED_LIMIT_INFORMATION
+	if kill {
+		info.BasicLimitInformation.LimitFlags = windows.JOB_OBJECT_LIMIT_KILL_ON_JOB_CLOSE
+	}
+	_, err := windows.SetInformationJobObject(job, windows.JobObjectExtendedLimitInformation, uintptr(unsafe.Pointer(&info)), uint32(unsafe.Sizeof(info)))
+	return err
+}
@@ -2,16 +2,55 @@ package provider
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 
+	"github.com/hashicorp/terraform-plugin-framework-validators/int64validator"
+	"github.com/hashicorp/terraform-plugin-framework-validators/listvalidator"
+	"github.com/hashicorp/terraform-plugin-framework/attr"
 	"github.com/hashicorp/terraform-plugin-framework/datasource"
+	"github.com/hashicorp/terraform-plugin-framework/diag"
+	"github.com/hashicorp/terraform-plugin-framework/path"
 	"github.com/hashicorp/terraform-plugin-framework/provider"
+	"github.com/hashicorp/terraform-plugin-framework/provider/schema"
 	"github.com/hashicorp/terraform-plugin-framework/resource"
+	"github.com/hashicorp/terraform-plugin-framework/schema/validator"
+	"github.com/hashicorp/terraform-plugin-framework/tfsdk"
+	"github.com/hashicorp/terraform-plugin-framework/types"
 )
 
 var _ provider.Provider = (*toolboxProvider)(nil)
+var _ provider.ProviderWithValidateConfig = (*toolboxProvider)(nil)
 
 type toolboxProvider struct{}
 
+// toolboxProviderModel is the provider configuration, which holds the defaults of every `toolbox_external`
+// resource. It is passed to the resources as their provider data.
+type toolboxProviderModel struct {
+	WorkingDir  types.String `tfsdk:"working_dir"`
+	Environment types.Map    `tfsdk:"environment"`
+	Query       types.Map    `tfsdk:"query"`
+	Create      types.Bool   `tfsdk:"create"`
+	Read        types.Bool   `tfsdk:"read"`
+	Update      types.Bool   `tfsdk:"update"`
+	Delete      types.Bool   `tfsdk:"delete"`
+	Plan        types.Bool   `tfsdk:"plan"`
+
+	AllowedPrograms  types.List   `tfsdk:"allowed_programs"`
+	DeniedPrograms   types.List   `tfsdk:"denied_programs"`
+	AllowedArguments types.String `tfsdk:"allowed_arguments"`
+
+	MaxConcurrentPrograms types.Int64 `tfsdk:"max_concurrent_programs"`
+
+	Timeouts *externalTimeoutsModel `tfsdk:"timeouts"`
+}
+
+// toolboxProviderData is passed by the provider to its resources.
+type toolboxProviderData struct {
+	Defaults *toolboxProviderModel
+	Limiter  *programLimiter
+}
+
 func New() provider.Provider {
 	return &toolboxProvider{}
 }
@@ -20,7 +59,42 @@ func (p *toolboxProvider) Metadata(ctx context.Context, req provider.MetadataReq
 	resp.TypeName = "toolbox"
 }
 
+// ValidateConfig rejects the defaults which no resource could use. The defaults which depend on the configuration of
+// each resource are validated when the resource is planned.
+func (p *toolboxProvider) ValidateConfig(ctx context.Context, req provider.ValidateConfigRequest, resp *provider.ValidateConfigResponse) {
+	var config toolboxProviderModel
+
+	resp.Diagnostics.Append(req.Config.Get(ctx, &config)...)
+	if resp.Diagnostics.HasError() || config.Query.IsUnknown() {
+		return
+	}
+
+	for key := range config.Query.Elements() {
+		if reservedQueryKeys[key] {
+			resp.Diagnostics.AddAttributeError(path.Root("query").AtMapKey(key),
+				"Reserved Query Key",
+				fmt.Sprintf("The provider was configured with a reserved query key: %s", key),
+			)
+		}
+	}
+}
+
 func (p *toolboxProvider) Configure(ctx context.Context, req provider.ConfigureRequest, resp *provider.ConfigureResponse) {
+	var config toolboxProviderModel
+
+	resp.Diagnostics.Append(req.Config.Get(ctx, &config)...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	maxConcurrent := 0
+	if !config.MaxConcurrentPrograms.IsNull() && !config.MaxConcurrentPrograms.IsUnknown() {
+		maxConcurrent = int(config.MaxConcurrentPrograms.ValueInt64())
+	}
+	resp.ResourceData = &toolboxProviderData{
+		Defaults: &config,
+		Limiter:  newProgramLimiter(maxConcurrent),
+	}
 }
 
 func (p *toolboxProvider) DataSources(ctx context.Context) []func() datasource.DataSource {
@@ -33,5 +107,306 @@ func (p *toolboxProvider) Resources(ctx context.Context) []func() resource.Resou
 	}
 }
 
-func (p *toolboxProvider) Schema(context.Context, provider.SchemaRequest, *provider.SchemaResponse) {
+func (p *toolboxProvider) Schema(ctx context.Context, req provider.SchemaRequest, resp *provider.SchemaResponse) {
+	resp.Schema = schema.Schema{
+		Description: "Defaults of every `toolbox_external` resource, which the settings of a resource override.",
+
+		Attributes: map[string]schema.Attribute{
+			"working_dir": schema.StringAttribute{
+				Description: "Working directory of the programs of the resources which do not set `working_dir`.",
+				Optional:    true,
+			},
+			"environment": schema.MapAttribute{
+				Description: "Environment variables set for the programs, below the `environment` and " +
+					"`sensitive_environment` of each resource.",
+				ElementType: types.StringType,
+				Optional:    true,
+			},
+			"query": schema.MapAttribute{
+				Description: "Query keys passed to the programs, unless a resource sets the same key in its " +
+					"`query` or `sensitive_query`.",
+				ElementType: types.StringType,
+				Optional:    true,
+			},
+			"create": providerStageAttribute("create"),
+			"read":   providerStageAttribute("read"),
+			"update": providerStageAttribute("update"),
+			"delete": providerStageAttribute("delete"),
+			"plan":   providerStageAttribute("plan"),
+
+			"allowed_programs": schema.ListAttribute{
+				Description: "Patterns of the programs the resources may run, matched against the whole path " +
+					"the program resolves to in `PATH` or from the working directory: globs such as `/usr/bin/*`, " +
+					"or regular expressions prefixed with `regexp:`. A resource configuring any other program " +
+					"fails the plan. If not supplied, every program is allowed.",
+				ElementType: types.StringType,
+				Optional:    true,
+				Validators: []validator.List{
+					listvalidator.ValueStringsAre(programPatternValidator{}),
+				},
+			},
+			"denied_programs": schema.ListAttribute{
+				Description: "Patterns of the programs the resources may not run, in the same format as " +
+					"`allowed_programs`. A resource configuring a matching program fails the plan.",
+				ElementType: types.StringType,
+				Optional:    true,
+				Validators: []validator.List{
+					listvalidator.ValueStringsAre(programPatternValidator{}),
+				},
+			},
+			"max_concurrent_programs": schema.Int64Attribute{
+				Description: "How many programs of the resources may run at once. Terraform runs up to " +
+					"`-parallelism` resources at once, which is 10 by default. If not supplied, the programs " +
+					"are not limited.",
+				Optional: true,
+				Validators: []validator.Int64{
+					int64validator.AtLeast(1),
+				},
+			},
+			"allowed_arguments": schema.StringAttribute{
+				Description: "A regular expression every argument of the programs must match as a whole. A " +
+					"resource configuring any other argument fails the plan.",
+				Optional: true,
+				Validators: []validator.String{
+					regexpValidator{},
+				},
+			},
+		},
+
+		Blocks: map[string]schema.Block{
+			"timeouts": schema.SingleNestedBlock{
+				Description: "Time limits of the stages of the resources which do not set them in their own " +
+					"`timeouts` block.",
+				Attributes: map[string]schema.Attribute{
+					"create":       providerTimeoutAttribute("create"),
+					"read":         providerTimeoutAttribute("read"),
+					"update":       providerTimeoutAttribute("update"),
+					"delete":       providerTimeoutAttribute("delete"),
+					"plan":         providerTimeoutAttribute("plan"),
+					"grace_period": providerTimeoutAttribute("grace_period"),
+				},
+			},
+		},
+	}
+}
+
+// providerStageAttribute returns the schema of the default of a stage flag of the resources.
+func providerStageAttribute(stage string) schema.BoolAttribute {
+	return schema.BoolAttribute{
+		Description: "Default of `" + stage + "` for the resources which do not set it.",
+		Optional:    true,
+	}
+}
+
+// providerTimeoutAttribute returns the schema of the default of an attribute of the `timeouts` block of the
+// resources.
+func providerTimeoutAttribute(name string) schema.StringAttribute {
+	return schema.StringAttribute{
+		Description: "Default of `timeouts." + name + "`, such as `30s` or `10m`.",
+		Optional:    true,
+		Validators: []validator.String{
+			durationValidator{},
+		},
+	}
+}
+
+// fullyKnown returns whether every value of the provider configuration is known, which it may not be during the
+// plan.
+func (d *toolboxProviderModel) fullyKnown() bool {
+	if d == nil {
+		return true
+	}
+	values := []attr.Value{
+		d.WorkingDir, d.Environment, d.Query, d.Create, d.Read, d.Update, d.Delete, d.Plan,
+		d.AllowedPrograms, d.DeniedPrograms, d.AllowedArguments, d.MaxConcurrentPrograms,
+	}
+	if d.Timeouts != nil {
+		values = append(values, d.Timeouts.Create, d.Timeouts.Read, d.Timeouts.Update, d.Timeouts.Delete, d.Timeouts.Plan, d.Timeouts.GracePeriod)
+	}
+	for _, value := range values {
+		if value.IsUnknown() {
+			return false
+		}
+	}
+	return true
+}
+
+// validateDefaults validates the defaults which apply to the resource configuration, as the configuration of the
+// resource is validated without them. The errors name the attribute of the provider configuration they come from.
+func (d *toolboxProviderModel) validateDefaults(ctx context.Context, m externalResourceModelV0) diag.Diagnostics {
+	var diags diag.Diagnostics
+	if d == nil {
+		return diags
+	}
+
+	// Stages the resource does not configure are enabled by the provider, which does not know their programs
+	for _, stage := range externalStages {
+		enabled := d.stageDefault(stage)
+		if !m.stageEnabled(stage).IsNull() || enabled.IsUnknown() || !enabled.ValueBool() {
+			continue
+		}
+		program, programPath := m.stageProgram(stage)
+		if args, known := programArgs(program); !known || len(args) > 0 {
+			continue
+		}
+		diags.AddError(
+			"External Program Missing",
+			fmt.Sprintf("The provider configuration sets `%[1]s = true` for the resources which do not set `%[1]s`, "+
+				"but the resource was configured without a program to execute for the %[1]s stage. Set `%[2]s` on "+
+				"the resource, or `%[1]s = false` to disable the stage.", stage, programPath),
+		)
+	}
+
+	// Keys of the resource replace the keys of the provider, which must be valid for the resource
+	if d.Query.IsNull() || d.Query.IsUnknown() || m.Query.IsUnknown() || m.SensitiveQuery.IsUnknown() {
+		return diags
+	}
+	for key, element := range d.Query.Elements() {
+		if _, ok := m.Query.Elements()[key]; ok {
+			continue
+		}
+		if _, ok := m.SensitiveQuery.Elements()[key]; ok {
+			continue
+		}
+		if m.reservedQueryKey(key) {
+			diags.AddError(
+				"Reserved Query Key",
+				fmt.Sprintf("The provider configuration sets the query key %q, which is reserved by the resource. "+
+					"Remove the key from the `query` of the provider configuration.", key),
+			)
+			continue
+		}
+		value, ok := element.(types.String)
+		if m.QueryEncoding.ValueString() != queryEncodingJSON || !ok || value.IsNull() || value.IsUnknown() || json.Valid([]byte(value.ValueString())) {
+			continue
+		}
+		diags.AddAttributeError(path.Root("query_encoding"),
+			"Invalid Query Value",
+			fmt.Sprintf("The value of the key %q of the `query` of the provider configuration is not valid JSON, got: %q. ", key, value.ValueString())+
+				"With `query_encoding = \"json\"` every value must be encoded, for example with jsonencode.",
+		)
+	}
+	return diags
+}
+
+// stageDefault returns the default of the crud flag of the resources for the given stage.
+func (d *toolboxProviderModel) stageDefault(stage string) types.Bool {
+	switch stage {
+	case "create":
+		return d.Create
+	case "read":
+		return d.Read
+	case "update":
+		return d.Update
+	case "delete":
+		return d.Delete
+	case "plan":
+		return d.Plan
+	default:
+		return types.BoolNull()
+	}
+}
+
+// apply returns the resource model with the provider defaults filled in, which is what the program runs with. It is
+// never stored: the state keeps what the resource configured.
+func (d *toolboxProviderModel) apply(ctx context.Context, m externalResourceModelV0) (externalResourceModelV0, diag.Diagnostics) {
+	var diags diag.Diagnostics
+	if d == nil {
+		return m, diags
+	}
+
+	if m.WorkingDir.IsNull() && !d.WorkingDir.IsUnknown() {
+		m.WorkingDir = d.WorkingDir
+	}
+	if m.Plan.IsNull() && !d.Plan.IsUnknown() {
+		m.Plan = d.Plan
+	}
+
+	// Keys of the resource win over the keys of the provider, a query key can not be both plain and sensitive
+	var sensitiveQuery map[string]types.String
+	diags.Append(m.SensitiveQuery.ElementsAs(ctx, &sensitiveQuery, false)...)
+	if diags.HasError() {
+		return m, diags
+	}
+	var mapDiags diag.Diagnostics
+	m.Query, mapDiags = mergeDefaults(ctx, d.Query, m.Query, sensitiveQuery)
+	diags.Append(mapDiags...)
+	m.Environment, mapDiags = mergeDefaults(ctx, d.Environment, m.Environment, nil)
+	diags.Append(mapDiags...)
+
+	if d.Timeouts != nil {
+		timeouts := externalTimeoutsModel{
+			Create: types.StringNull(), Read: types.StringNull(), Update: types.StringNull(),
+			Delete: types.StringNull(), Plan: types.StringNull(), GracePeriod: types.StringNull(),
+		}
+		if m.Timeouts != nil {
+			timeouts = *m.Timeouts
+		}
+		for _, value := range []struct{ resource, provider *types.String }{
+			{&timeouts.Create, &d.Timeouts.Create},
+			{&timeouts.Read, &d.Timeouts.Read},
+			{&timeouts.Update, &d.Timeouts.Update},
+			{&timeouts.Delete, &d.Timeouts.Delete},
+			{&timeouts.Plan, &d.Timeouts.Plan},
+			{&timeouts.GracePeriod, &d.Timeouts.GracePeriod},
+		} {
+			if value.resource.IsNull() && !value.provider.IsUnknown() {
+				*value.resource = *value.provider
+			}
+		}
+		m.Timeouts = &timeouts
+	}
+
+	return m, diags
+}
+
+// planStageFlags plans the stage flags which the resource does not configure with the defaults of the provider.
+// The flags are computed, so unlike the other defaults they are stored in the state.
+func (d *toolboxProviderModel) planStageFlags(ctx context.Context, config tfsdk.Config, plan *tfsdk.Plan) diag.Diagnostics {
+	var diags diag.Diagnostics
+	if d == nil {
+		return diags
+	}
+
+	for stage, value := range map[string]types.Bool{"create": d.Create, "read": d.Read, "update": d.Update, "delete": d.Delete} {
+		if value.IsNull() {
+			continue
+		}
+		var configured types.Bool
+		diags.Append(config.GetAttribute(ctx, path.Root(stage), &configured)...)
+		if diags.HasError() {
+			return diags
+		}
+		if configured.IsNull() {
+			diags.Append(plan.SetAttribute(ctx, path.Root(stage), value)...)
+		}
+	}
+	return diags
+}
+
+// mergeDefaults returns the values of the resource on top of the defaults of the provider, leaving out the
+// defaults whose key is excluded.
+func mergeDefaults(ctx context.Context, defaults types.Map, values types.Map, excluded map[string]types.String) (types.Map, diag.Diagnostics) {
+	var diags diag.Diagnostics
+	if defaults.IsNull() || defaults.IsUnknown() || values.IsUnknown() {
+		return values, diags
+	}
+
+	merged := map[string]types.String{}
+	diags.Append(defaults.ElementsAs(ctx, &merged, false)...)
+	for key := range excluded {
+		delete(merged, key)
+	}
+	var resourceValues map[string]types.String
+	diags.Append(values.ElementsAs(ctx, &resourceValues, false)...)
+	if diags.HasError() {
+		return values, diags
+	}
+	for key, value := range resourceValues {
+		merged[key] = value
+	}
+
+	result, mapDiags := types.MapValueFrom(ctx, types.StringType, merged)
+	diags.Append(mapDiags...)
+	return result, diags
 }
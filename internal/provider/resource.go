@@ -5,10 +5,18 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"os"
 	"os/exec"
+	"regexp"
 	"runtime"
+	"sort"
+	"strings"
+	"time"
 
+	"github.com/hashicorp/terraform-plugin-framework-validators/int64validator"
 	"github.com/hashicorp/terraform-plugin-framework-validators/listvalidator"
+	"github.com/hashicorp/terraform-plugin-framework-validators/stringvalidator"
+	"github.com/hashicorp/terraform-plugin-framework/attr"
 	"github.com/hashicorp/terraform-plugin-framework/diag"
 	"github.com/hashicorp/terraform-plugin-framework/path"
 	"github.com/hashicorp/terraform-plugin-framework/resource"
@@ -24,22 +32,179 @@ import (
 	"github.com/hashicorp/terraform-plugin-log/tflog"
 )
 
-type externalResource struct{}
+type externalResource struct {
+	// defaults is the provider configuration, nil until the resource is configured.
+	defaults *toolboxProviderModel
+	// limiter is shared by the resources of the provider, nil until the resource is configured.
+	limiter *programLimiter
+}
 type externalResourceModelV0 struct {
-	Program    types.List   `tfsdk:"program"`
-	Create     types.Bool   `tfsdk:"create"`
-	Read       types.Bool   `tfsdk:"read"`
-	Update     types.Bool   `tfsdk:"update"`
-	Delete     types.Bool   `tfsdk:"delete"`
-	WorkingDir types.String `tfsdk:"working_dir"`
-	Recreate   types.Map    `tfsdk:"recreate"`
-	Query      types.Map    `tfsdk:"query"`
-	Result     types.Map    `tfsdk:"result"`
-	Stage      types.String `tfsdk:"stage"`
-	ID         types.String `tfsdk:"id"`
+	Program         types.List   `tfsdk:"program"`
+	CreateProgram   types.List   `tfsdk:"create_program"`
+	ReadProgram     types.List   `tfsdk:"read_program"`
+	UpdateProgram   types.List   `tfsdk:"update_program"`
+	DeleteProgram   types.List   `tfsdk:"delete_program"`
+	PlanProgram     types.List   `tfsdk:"plan_program"`
+	RollbackProgram types.List   `tfsdk:"rollback_program"`
+	Create          types.Bool   `tfsdk:"create"`
+	Read            types.Bool   `tfsdk:"read"`
+	Update          types.Bool   `tfsdk:"update"`
+	Delete          types.Bool   `tfsdk:"delete"`
+	Plan            types.Bool   `tfsdk:"plan"`
+	WorkingDir      types.String `tfsdk:"working_dir"`
+	Recreate        types.Map    `tfsdk:"recreate"`
+	Query           types.Map    `tfsdk:"query"`
+	Input           types.String `tfsdk:"input"`
+	QueryEncoding   types.String `tfsdk:"query_encoding"`
+	Result          types.Map    `tfsdk:"result"`
+	ResultJSON      types.String `tfsdk:"result_json"`
+	Stage           types.String `tfsdk:"stage"`
+	ID              types.String `tfsdk:"id"`
+
+	SensitiveQuery      types.Map  `tfsdk:"sensitive_query"`
+	SensitiveResult     types.Map  `tfsdk:"sensitive_result"`
+	SensitiveResultKeys types.List `tfsdk:"sensitive_result_keys"`
+
+	Environment             types.Map    `tfsdk:"environment"`
+	SensitiveEnvironment    types.Map    `tfsdk:"sensitive_environment"`
+	InheritEnvironment      types.String `tfsdk:"inherit_environment"`
+	InheritEnvironmentNames types.List   `tfsdk:"inherit_environment_names"`
+
+	LockName        types.String `tfsdk:"lock_name"`
+	LockFile        types.String `tfsdk:"lock_file"`
+	LockTimeout     types.String `tfsdk:"lock_timeout"`
+	OnFailure       types.String `tfsdk:"on_failure"`
+	LastError       types.String `tfsdk:"last_error"`
+	OnDeleteFailure types.String `tfsdk:"on_delete_failure"`
+	LogStdout       types.Bool   `tfsdk:"log_stdout"`
+	CaptureOutput   types.Bool   `tfsdk:"capture_output"`
+	CaptureMaxBytes types.Int64  `tfsdk:"capture_max_bytes"`
+	Stderr          types.String `tfsdk:"stderr"`
+	ExitCode        types.Int64  `tfsdk:"exit_code"`
+	DurationMs      types.Int64  `tfsdk:"duration_ms"`
+	LastRunAt       types.String `tfsdk:"last_run_at"`
+
+	Timeouts *externalTimeoutsModel `tfsdk:"timeouts"`
+	Retry    *externalRetryModel    `tfsdk:"retry"`
+}
+
+type externalTimeoutsModel struct {
+	Create      types.String `tfsdk:"create"`
+	Read        types.String `tfsdk:"read"`
+	Update      types.String `tfsdk:"update"`
+	Delete      types.String `tfsdk:"delete"`
+	Plan        types.String `tfsdk:"plan"`
+	GracePeriod types.String `tfsdk:"grace_period"`
+}
+
+type externalRetryModel struct {
+	MaxAttempts             types.Int64  `tfsdk:"max_attempts"`
+	InitialBackoff          types.String `tfsdk:"initial_backoff"`
+	MaxBackoff              types.String `tfsdk:"max_backoff"`
+	RetryableExitCodes      types.List   `tfsdk:"retryable_exit_codes"`
+	RetryableStderrPatterns types.List   `tfsdk:"retryable_stderr_patterns"`
+	Stages                  types.List   `tfsdk:"stages"`
+}
+
+// externalOutput holds the values returned by the program for a stage.
+type externalOutput struct {
+	Result          types.Map
+	SensitiveResult types.Map
+	// ResultJSON is the JSON object returned by the program with the types of its values, without the sensitive
+	// and reserved keys.
+	ResultJSON types.String
+	// Stderr, ExitCode, DurationMs and LastRunAt describe the last run of the program when capture_output is
+	// enabled, they are null otherwise.
+	Stderr     types.String
+	ExitCode   types.Int64
+	DurationMs types.Int64
+	LastRunAt  types.String
+	// Exists is false when the program reported through the reserved `__exists` key that the object it manages
+	// no longer exists.
+	Exists bool
+	// ID is the `id` returned by the program on create or import, null when it was not returned.
+	ID types.String
+	// RequiresReplace is set by the plan stage through the reserved `__requires_replace` key.
+	RequiresReplace bool
+	// Predicted is set by the plan stage through the reserved `__predicted` key when its result predicts the one
+	// of the create or update stage.
+	Predicted bool
+	// Warnings are returned by the plan stage through the reserved `__warnings` key.
+	Warnings []string
+	// Private is the JSON object returned through the reserved `__private` key, or the previous one when the
+	// program did not return it.
+	Private []byte
+	// Failed is set when the program failed and on_failure keeps what it returned, the diagnostics then hold the
+	// errors of the failure.
+	Failed bool
+	// Run is the last run of the program, nil when it did not run.
+	Run *externalRun
+	// Rollback reports the outcome of the rollback program when the update stage failed.
+	Rollback diag.Diagnostics
+	// Secrets are the sensitive values of the run, including the ones the program returned.
+	Secrets []string
+}
+
+// reservedQueryKeys are set by the provider in the JSON object passed to the program.
+var reservedQueryKeys = map[string]bool{
+	"stage":         true,
+	"old_result":    true,
+	toolboxQueryKey: true,
+}
+
+// toolboxQueryKey is the key of the JSON object passed to the program which holds the metadata of the resource set
+// by the provider, such as its id, so it does not take names away from query.
+const toolboxQueryKey = "__toolbox"
+
+// privateStateKey is the key of the private state holding the `__private` object returned by the program.
+const privateStateKey = "program_private"
+
+// externalImportID is the JSON document used as the import ID of the resource.
+type externalImportID struct {
+	Program    []string          `json:"program"`
+	Query      map[string]string `json:"query"`
+	WorkingDir string            `json:"working_dir"`
 }
 
+// Modes of the inherit_environment attribute.
+const (
+	inheritEnvironmentAll       = "all"
+	inheritEnvironmentNone      = "none"
+	inheritEnvironmentAllowlist = "allowlist"
+)
+
+// Modes of the query_encoding attribute.
+const (
+	queryEncodingAuto = "auto"
+	queryEncodingRaw  = "raw"
+	queryEncodingJSON = "json"
+)
+
+// Modes of the on_failure attribute.
+const (
+	onFailureFail     = "fail"
+	onFailureContinue = "continue"
+	onFailureTaint    = "taint"
+)
+
+// Modes of the on_delete_failure attribute.
+const (
+	onDeleteFailureFail          = "fail"
+	onDeleteFailureWarnAndForget = "warn_and_forget"
+)
+
+// defaultGracePeriod is how long a timed out or cancelled program has to exit after SIGTERM or SIGINT before it is
+// killed.
+const defaultGracePeriod = 10 * time.Second
+
+// externalStages are the stages which can be enabled on the resource, in the order they are validated.
+var externalStages = []string{"create", "read", "update", "delete", "plan"}
+
 var _ resource.Resource = (*externalResource)(nil)
+var _ resource.ResourceWithValidateConfig = (*externalResource)(nil)
+var _ resource.ResourceWithImportState = (*externalResource)(nil)
+var _ resource.ResourceWithModifyPlan = (*externalResource)(nil)
+var _ resource.ResourceWithConfigure = (*externalResource)(nil)
 
 func NewExternalResource() resource.Resource {
 	return &externalResource{}
@@ -49,6 +214,24 @@ func (e *externalResource) Metadata(_ context.Context, req resource.MetadataRequ
 	resp.TypeName = req.ProviderTypeName + "_external"
 }
 
+func (e *externalResource) Configure(_ context.Context, req resource.ConfigureRequest, resp *resource.ConfigureResponse) {
+	// The provider is not configured yet when the configuration is validated
+	if req.ProviderData == nil {
+		return
+	}
+
+	data, ok := req.ProviderData.(*toolboxProviderData)
+	if !ok {
+		resp.Diagnostics.AddError(
+			"Unexpected Resource Configure Type",
+			fmt.Sprintf("Expected *toolboxProviderData, got: %T. Please report this issue to the provider developers.", req.ProviderData),
+		)
+		return
+	}
+	e.defaults = data.Defaults
+	e.limiter = data.Limiter
+}
+
 func (e *externalResource) Schema(ctx context.Context, req resource.SchemaRequest, resp *resource.SchemaResponse) {
 	resp.Schema = schema.Schema{
 		Description: "The `external` resource allows an external program implementing a specific protocol " +
@@ -83,9 +266,10 @@ func (e *externalResource) Schema(ctx context.Context, req resource.SchemaReques
 				Description: "A list of strings, whose first element is the program to run and whose " +
 					"subsequent elements are optional command line arguments to the program. Terraform does " +
 					"not execute the program through a shell, so it is not necessary to escape shell " +
-					"metacharacters nor add quotes around arguments containing spaces.",
+					"metacharacters nor add quotes around arguments containing spaces. Used by every enabled " +
+					"stage which does not set its own stage program.",
 				ElementType: types.StringType,
-				Required:    true,
+				Optional:    true,
 				Validators: []validator.List{
 					listvalidator.SizeAtLeast(1),
 				},
@@ -94,6 +278,24 @@ func (e *externalResource) Schema(ctx context.Context, req resource.SchemaReques
 				},
 			},
 
+			"create_program": stageProgramAttribute("create"),
+			"read_program":   stageProgramAttribute("read"),
+			"update_program": stageProgramAttribute("update"),
+			"delete_program": stageProgramAttribute("delete"),
+			"plan_program":   stageProgramAttribute("plan"),
+
+			"rollback_program": schema.ListAttribute{
+				Description: "A list of strings, in the same format as `program`, to run when the update stage " +
+					"fails after its program ran. The rollback program receives the previous result, the query " +
+					"given to the update program and the output of its failed run, and its outcome is reported " +
+					"as an additional diagnostic.",
+				ElementType: types.StringType,
+				Optional:    true,
+				Validators: []validator.List{
+					listvalidator.SizeAtLeast(1),
+				},
+			},
+
 			"create": schema.BoolAttribute{
 				Description: "Run on create: enabled by default",
 				Optional:    true,
@@ -134,15 +336,62 @@ func (e *externalResource) Schema(ctx context.Context, req resource.SchemaReques
 				},
 			},
 
+			"plan": schema.BoolAttribute{
+				Description: "Run on plan to predict the result, require a replacement or report warnings, which " +
+					"requires `update` to be enabled: disabled by default",
+				Optional: true,
+			},
+
 			"working_dir": schema.StringAttribute{
 				Description: "Working directory of the program. If not supplied, the program will run " +
-					"in the current directory.",
+					"in the `working_dir` of the provider, or in the current directory.",
 				Optional: true,
 				PlanModifiers: []planmodifier.String{
 					stringplanmodifier.UseStateForUnknown(),
 				},
 			},
 
+			"environment": schema.MapAttribute{
+				Description: "A map of environment variables to set for the program. They are added on top of " +
+					"the variables inherited from Terraform, and a null value removes an inherited variable.",
+				ElementType: types.StringType,
+				Optional:    true,
+				PlanModifiers: []planmodifier.Map{
+					mapplanmodifier.UseStateForUnknown(),
+				},
+			},
+
+			"sensitive_environment": schema.MapAttribute{
+				Description: "A map of environment variables to set for the program, such as credentials, which " +
+					"are hidden from the plan output. They take precedence over `environment`.",
+				ElementType: types.StringType,
+				Optional:    true,
+				Sensitive:   true,
+				PlanModifiers: []planmodifier.Map{
+					mapplanmodifier.UseStateForUnknown(),
+				},
+			},
+
+			"inherit_environment": schema.StringAttribute{
+				Description: "Which environment variables of the Terraform process are passed to the program: " +
+					"`all` (default), `none`, or `allowlist` to only pass the variables named in " +
+					"`inherit_environment_names`.",
+				Optional: true,
+				Validators: []validator.String{
+					stringvalidator.OneOf(inheritEnvironmentAll, inheritEnvironmentNone, inheritEnvironmentAllowlist),
+				},
+			},
+
+			"inherit_environment_names": schema.ListAttribute{
+				Description: "Names of the environment variables of the Terraform process passed to the program " +
+					"when `inherit_environment` is `allowlist`. Variables which are not set are skipped.",
+				ElementType: types.StringType,
+				Optional:    true,
+				PlanModifiers: []planmodifier.List{
+					listplanmodifier.UseStateForUnknown(),
+				},
+			},
+
 			"query": schema.MapAttribute{
 				Description: "A map of string values to pass to the external program as the query " +
 					"arguments. If not supplied, the program will receive an empty object as its input.",
@@ -153,22 +402,432 @@ func (e *externalResource) Schema(ctx context.Context, req resource.SchemaReques
 				},
 			},
 
+			"query_encoding": schema.StringAttribute{
+				Description: "How the values of `query`, `sensitive_query` and `old_result` are passed to the " +
+					"program: `auto` (default) decodes the values which are valid JSON and passes the others as " +
+					"strings, `raw` always passes strings and `json` requires every query value to be valid JSON.",
+				Optional: true,
+				Validators: []validator.String{
+					stringvalidator.OneOf(queryEncodingAuto, queryEncodingRaw, queryEncodingJSON),
+				},
+			},
+
+			"input": schema.StringAttribute{
+				Description: "A JSON document, usually built with `jsonencode`, to pass to the external program " +
+					"in the `input` key. Unlike `query`, the program receives its values with their types, such " +
+					"as numbers, booleans, lists and nested objects.",
+				Optional: true,
+				Validators: []validator.String{
+					jsonValidator{},
+				},
+			},
+
+			"sensitive_query": schema.MapAttribute{
+				Description: "A map of string values, such as passwords, which are merged into the query passed " +
+					"to the external program and hidden from the plan output and the provider logs. Keys must not " +
+					"also be set in `query`.",
+				ElementType: types.StringType,
+				Optional:    true,
+				Sensitive:   true,
+				PlanModifiers: []planmodifier.Map{
+					mapplanmodifier.UseStateForUnknown(),
+				},
+			},
+
+			"sensitive_result_keys": schema.ListAttribute{
+				Description: "Keys of the program output which are stored in `sensitive_result` instead of " +
+					"`result`. Keys of `sensitive_query` returned by the program are always treated as sensitive.",
+				ElementType: types.StringType,
+				Optional:    true,
+				PlanModifiers: []planmodifier.List{
+					listplanmodifier.UseStateForUnknown(),
+				},
+			},
+
 			"result": schema.MapAttribute{
 				Description: "A map of string values returned from the external program.",
 				ElementType: types.StringType,
 				Computed:    true,
 			},
 
-			"id": schema.StringAttribute{
-				Description: "The id of the resource. This will always be set to `-`",
+			"result_json": schema.StringAttribute{
+				Description: "The JSON object returned from the external program, keeping the types of its " +
+					"values such as numbers, booleans, lists and nested objects. Sensitive keys are left out. " +
+					"Use `jsondecode` to access the values.",
+				Computed: true,
+			},
+
+			"sensitive_result": schema.MapAttribute{
+				Description: "A map of string values returned from the external program for the sensitive keys. " +
+					"These values are hidden from the plan output and the provider logs.",
+				ElementType: types.StringType,
+				Computed:    true,
+				Sensitive:   true,
+			},
+
+			"lock_name": schema.StringAttribute{
+				Description: "The programs of the resources sharing a lock name run one at a time, for " +
+					"example the resources running playbooks against the same hosts.",
+				Optional: true,
+			},
+
+			"lock_file": schema.StringAttribute{
+				Description: "Path of a file the program holds an exclusive lock on while it runs, which is " +
+					"created when it does not exist. Unlike `lock_name`, the lock is shared with other Terraform " +
+					"runs on the same machine, such as pipelines applying different workspaces against the " +
+					"same hosts.",
+				Optional: true,
+			},
+
+			"lock_timeout": schema.StringAttribute{
+				Description: "How long to wait for the lock of `lock_file`, such as `5m`, before failing with " +
+					"the process ID of its holder. If not supplied, the program waits until Terraform cancels " +
+					"the operation.",
+				Optional: true,
+				Validators: []validator.String{
+					durationValidator{},
+				},
+			},
+
+			"on_failure": schema.StringAttribute{
+				Description: "What happens when the program fails on create or update: `fail` (default) fails " +
+					"the apply without saving what the program returned, `continue` saves it along with the error " +
+					"in `last_error` and reports the failure as a warning, `taint` saves it along with the error " +
+					"and fails the apply, so the next apply replaces the resource.",
+				Optional: true,
+				Validators: []validator.String{
+					stringvalidator.OneOf(onFailureFail, onFailureContinue, onFailureTaint),
+				},
+			},
+
+			"last_error": schema.StringAttribute{
+				Description: "The error of the last create or update when the program failed and `on_failure` " +
+					"is `continue` or `taint`, null otherwise.",
+				Computed: true,
+			},
+
+			"on_delete_failure": schema.StringAttribute{
+				Description: "What happens when the program fails on delete: `fail` (default) keeps the resource " +
+					"in the state and fails the destroy, `warn_and_forget` reports the failure as a warning and " +
+					"removes the resource from the state.",
+				Optional: true,
+				Validators: []validator.String{
+					stringvalidator.OneOf(onDeleteFailureFail, onDeleteFailureWarnAndForget),
+				},
+			},
+
+			"log_stdout": schema.BoolAttribute{
+				Description: "Log the stdout of the program line by line while it runs, like its stderr. Cannot " +
+					"be used with `sensitive_query` or `sensitive_result_keys`: disabled by default",
+				Optional: true,
+			},
+
+			"capture_output": schema.BoolAttribute{
+				Description: "Store the stderr, exit code, duration and start time of the last run of the " +
+					"program in `stderr`, `exit_code`, `duration_ms` and `last_run_at`: disabled by default",
+				Optional: true,
+			},
+
+			"capture_max_bytes": schema.Int64Attribute{
+				Description: fmt.Sprintf("How many bytes of the end of stderr are stored in `stderr` when "+
+					"`capture_output` is enabled. Defaults to %d.", defaultCaptureMaxBytes),
+				Optional: true,
+				Validators: []validator.Int64{
+					int64validator.AtLeast(1),
+				},
+			},
+
+			"stderr": schema.StringAttribute{
+				Description: "The end of what the program wrote to stderr during its last run, with sensitive " +
+					"values redacted. Only set when `capture_output` is enabled.",
+				Computed: true,
+			},
+
+			"exit_code": schema.Int64Attribute{
+				Description: "The exit code of the last run of the program. Only set when `capture_output` is enabled.",
 				Computed:    true,
 			},
 
+			"duration_ms": schema.Int64Attribute{
+				Description: "How long the last run of the program took, in milliseconds. Only set when " +
+					"`capture_output` is enabled.",
+				Computed: true,
+			},
+
+			"last_run_at": schema.StringAttribute{
+				Description: "When the last run of the program started, in RFC 3339 format. Only set when " +
+					"`capture_output` is enabled.",
+				Computed: true,
+			},
+
+			"id": schema.StringAttribute{
+				Description: "The id of the resource. Set from the `id` key returned by the program on create " +
+					"or import, otherwise `-`. It does not change for the lifetime of the resource.",
+				Computed: true,
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.UseStateForUnknown(),
+				},
+			},
+
 			"stage": schema.StringAttribute{
 				Description: "The stage of the resource.",
 				Computed:    true,
 			},
 		},
+
+		Blocks: map[string]schema.Block{
+			"timeouts": schema.SingleNestedBlock{
+				Description: "Time limits for each stage of the program. When a limit is reached, the program's " +
+					"process group is sent SIGTERM and, if it is still running after `grace_period`, SIGKILL. " +
+					"If a stage has no limit, the program runs until Terraform cancels the operation, which sends " +
+					"SIGINT to the process group instead.",
+				Attributes: map[string]schema.Attribute{
+					"create": stageTimeoutAttribute("create"),
+					"read":   stageTimeoutAttribute("read"),
+					"update": stageTimeoutAttribute("update"),
+					"delete": stageTimeoutAttribute("delete"),
+					"plan":   stageTimeoutAttribute("plan"),
+					"grace_period": schema.StringAttribute{
+						Description: "How long a timed out or cancelled program is given to exit after SIGTERM or " +
+							"SIGINT before it is killed, and how long the processes it leaves in the background may " +
+							"keep its output open after it exited, such as `30s`. Defaults to `10s`.",
+						Optional: true,
+						Validators: []validator.String{
+							durationValidator{},
+						},
+					},
+				},
+			},
+
+			"retry": schema.SingleNestedBlock{
+				Description: "Run the program again when it fails with a non-zero exit code, waiting longer " +
+					"after every attempt. Timed out runs are not retried.",
+				Attributes: map[string]schema.Attribute{
+					"max_attempts": schema.Int64Attribute{
+						Description: fmt.Sprintf("How many times the program is run before the stage fails, "+
+							"including the first run. Defaults to %d.", defaultRetryMaxAttempts),
+						Optional: true,
+						Validators: []validator.Int64{
+							int64validator.AtLeast(1),
+						},
+					},
+					"initial_backoff": schema.StringAttribute{
+						Description: fmt.Sprintf("How long to wait after the first failed attempt, doubled after "+
+							"every attempt, such as `5s`. Defaults to `%s`.", defaultRetryInitialBackoff),
+						Optional: true,
+						Validators: []validator.String{
+							durationValidator{},
+						},
+					},
+					"max_backoff": schema.StringAttribute{
+						Description: fmt.Sprintf("The longest wait between two attempts, such as `1m`. "+
+							"Defaults to `%s`.", defaultRetryMaxBackoff),
+						Optional: true,
+						Validators: []validator.String{
+							durationValidator{},
+						},
+					},
+					"retryable_exit_codes": schema.ListAttribute{
+						Description: "Exit codes of the program which are retried. If neither " +
+							"`retryable_exit_codes` nor `retryable_stderr_patterns` is supplied, every non-zero " +
+							"exit code is retried.",
+						ElementType: types.Int64Type,
+						Optional:    true,
+					},
+					"retryable_stderr_patterns": schema.ListAttribute{
+						Description: "Regular expressions matched against the stderr of the program. A failure " +
+							"is retried when any of them matches.",
+						ElementType: types.StringType,
+						Optional:    true,
+						Validators: []validator.List{
+							listvalidator.ValueStringsAre(regexpValidator{}),
+						},
+					},
+					"stages": schema.ListAttribute{
+						Description: "The stages which are retried: `create`, `read`, `update`, `delete`, `plan` " +
+							"or `import`. If not supplied, every stage is retried.",
+						ElementType: types.StringType,
+						Optional:    true,
+						Validators: []validator.List{
+							listvalidator.ValueStringsAre(stringvalidator.OneOf(retryStages...)),
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// stageTimeoutAttribute returns the schema of the time limit for a single stage.
+func stageTimeoutAttribute(stage string) schema.StringAttribute {
+	return schema.StringAttribute{
+		Description: fmt.Sprintf("Time limit of the program on %s, such as `30s` or `10m`.", stage),
+		Optional:    true,
+		Validators: []validator.String{
+			durationValidator{},
+		},
+	}
+}
+
+// stageProgramAttribute returns the schema of an optional program which replaces `program` for a single stage.
+func stageProgramAttribute(stage string) schema.ListAttribute {
+	return schema.ListAttribute{
+		Description: fmt.Sprintf("A list of strings, in the same format as `program`, to run on %s instead "+
+			"of `program`. If not supplied, `program` is used.", stage),
+		ElementType: types.StringType,
+		Optional:    true,
+		Validators: []validator.List{
+			listvalidator.SizeAtLeast(1),
+		},
+		PlanModifiers: []planmodifier.List{
+			listplanmodifier.UseStateForUnknown(),
+		},
+	}
+}
+
+// ValidateConfig ensures every enabled stage resolves to a program with at least one non-empty value.
+func (e *externalResource) ValidateConfig(ctx context.Context, req resource.ValidateConfigRequest, resp *resource.ValidateConfigResponse) {
+	var config externalResourceModelV0
+
+	resp.Diagnostics.Append(req.Config.Get(ctx, &config)...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	// Group the stages by the program attribute they resolve to so each attribute is reported once
+	var missingPaths []path.Path
+	missingStages := map[string][]string{}
+	for _, stage := range externalStages {
+		enabled := config.stageEnabled(stage)
+		if enabled.IsUnknown() {
+			continue
+		}
+		// Unset flags fall back to the schema defaults: only create is enabled by default
+		if enabled.IsNull() && stage != "create" || !enabled.IsNull() && !enabled.ValueBool() {
+			continue
+		}
+
+		program, programPath := config.stageProgram(stage)
+		if args, known := programArgs(program); !known || len(args) > 0 {
+			continue
+		}
+
+		key := programPath.String()
+		if _, ok := missingStages[key]; !ok {
+			missingPaths = append(missingPaths, programPath)
+		}
+		missingStages[key] = append(missingStages[key], stage)
+	}
+
+	for _, programPath := range missingPaths {
+		resp.Diagnostics.AddAttributeError(programPath,
+			"External Program Missing",
+			fmt.Sprintf("The resource was configured without a program to execute for the enabled stage(s): %s. "+
+				"Verify the configuration contains at least one non-empty value in the stage program or `program`.",
+				strings.Join(missingStages[programPath.String()], ", ")),
+		)
+	}
+
+	// The rollback program only runs once an update failed, so it is checked before anything runs
+	if args, known := programArgs(config.RollbackProgram); known && !config.RollbackProgram.IsNull() && len(args) == 0 {
+		resp.Diagnostics.AddAttributeError(path.Root("rollback_program"),
+			"External Program Missing",
+			"The resource was configured without a rollback program to execute. Verify the configuration contains at least one non-empty value.",
+		)
+	}
+
+	// With the json encoding, every known query value must be a JSON document
+	if config.QueryEncoding.ValueString() == queryEncodingJSON {
+		for _, attribute := range []string{"query", "sensitive_query"} {
+			var values types.Map
+			resp.Diagnostics.Append(req.Config.GetAttribute(ctx, path.Root(attribute), &values)...)
+			if resp.Diagnostics.HasError() || values.IsUnknown() {
+				continue
+			}
+			for key, element := range values.Elements() {
+				value, ok := element.(types.String)
+				if !ok || value.IsNull() || value.IsUnknown() || json.Valid([]byte(value.ValueString())) {
+					continue
+				}
+				detail := fmt.Sprintf("The value of the key %q is not valid JSON, got: %q. ", key, value.ValueString())
+				if attribute == "sensitive_query" {
+					detail = fmt.Sprintf("The value of the key %q is not valid JSON. ", key)
+				}
+				resp.Diagnostics.AddAttributeError(path.Root(attribute).AtMapKey(key),
+					"Invalid Query Value",
+					detail+"With `query_encoding = \"json\"` every value must be encoded, for example with jsonencode.",
+				)
+			}
+		}
+	}
+
+	// The update stage must run for the result predicted by the plan stage to be applied
+	if config.Plan.ValueBool() && !config.Update.IsNull() && !config.Update.IsUnknown() && !config.Update.ValueBool() {
+		resp.Diagnostics.Append(planWithoutUpdate())
+	}
+
+	// Keys set by the provider in the JSON object passed to the program can not be configured
+	for _, values := range []struct {
+		attribute string
+		query     types.Map
+	}{
+		{"query", config.Query},
+		{"sensitive_query", config.SensitiveQuery},
+	} {
+		if values.query.IsUnknown() {
+			continue
+		}
+		for key := range values.query.Elements() {
+			if !config.reservedQueryKey(key) {
+				continue
+			}
+			resp.Diagnostics.AddAttributeError(path.Root(values.attribute).AtMapKey(key),
+				"Reserved Query Key",
+				fmt.Sprintf("The resource was configured with a reserved query key: %s", key),
+			)
+		}
+	}
+
+	// Values returned for sensitive keys are only known once the program exited, so its stdout can not be masked
+	// while it is logged
+	if config.LogStdout.ValueBool() {
+		for _, sensitive := range []struct {
+			attribute string
+			value     attr.Value
+			size      int
+		}{
+			{"sensitive_query", config.SensitiveQuery, len(config.SensitiveQuery.Elements())},
+			{"sensitive_result_keys", config.SensitiveResultKeys, len(config.SensitiveResultKeys.Elements())},
+		} {
+			if sensitive.value.IsUnknown() || sensitive.size == 0 {
+				continue
+			}
+			resp.Diagnostics.AddAttributeError(path.Root("log_stdout"),
+				"Sensitive Output Logged",
+				fmt.Sprintf("The resource was configured with `log_stdout = true` and `%s`. The values the program "+
+					"returns for sensitive keys would be written to the provider logs, remove `log_stdout`.", sensitive.attribute),
+			)
+			break
+		}
+	}
+
+	// The allowlist of inherited environment variables is only meaningful in allowlist mode
+	if !config.InheritEnvironment.IsUnknown() && !config.InheritEnvironmentNames.IsUnknown() {
+		allowlist := config.InheritEnvironment.ValueString() == inheritEnvironmentAllowlist
+		if allowlist && config.InheritEnvironmentNames.IsNull() {
+			resp.Diagnostics.AddAttributeError(path.Root("inherit_environment_names"),
+				"Missing Environment Allowlist",
+				"The resource was configured with `inherit_environment = \"allowlist\"` but without "+
+					"`inherit_environment_names`. Set the names of the variables to pass to the program.",
+			)
+		}
+		if !allowlist && !config.InheritEnvironmentNames.IsNull() {
+			resp.Diagnostics.AddAttributeError(path.Root("inherit_environment_names"),
+				"Unused Environment Allowlist",
+				"The resource was configured with `inherit_environment_names` but `inherit_environment` is not "+
+					"\"allowlist\". Set `inherit_environment = \"allowlist\"` or remove `inherit_environment_names`.",
+			)
+		}
 	}
 }
 
@@ -186,15 +845,29 @@ func (e *externalResource) Create(ctx context.Context, req resource.CreateReques
 	resp.Diagnostics.Append(req.Plan.Get(ctx, &config)...)
 	config.Stage = types.StringValue("create")
 	config.ID = types.StringValue("-")
+	config.ResultJSON = types.StringValue("{}")
+	config.Stderr = types.StringNull()
+	config.ExitCode = types.Int64Null()
+	config.DurationMs = types.Int64Null()
+	config.LastRunAt = types.StringNull()
 
-	result, errors := run_external(ctx, config, make(map[string]types.String))
+	output, errors := e.run(ctx, config, make(map[string]types.String), make(map[string]types.String), nil, nil)
 
-	if errors != nil {
+	if !output.Failed {
 		resp.Diagnostics.Append(errors...)
-		return
+		if errors.HasError() {
+			return
+		}
 	}
 
-	config.Result = result
+	config.setOutput(output)
+	resp.Diagnostics.Append(config.setFailure(output, errors)...)
+	if !output.ID.IsNull() {
+		config.ID = output.ID
+	}
+	if output.Private != nil {
+		resp.Diagnostics.Append(resp.Private.SetKey(ctx, privateStateKey, output.Private)...)
+	}
 
 	diags = resp.State.Set(ctx, &config)
 	resp.Diagnostics.Append(diags...)
@@ -221,24 +894,59 @@ func (e *externalResource) Update(ctx context.Context, req resource.UpdateReques
 	resp.Diagnostics.Append(req.Plan.Get(ctx, &config)...)
 	config.Stage = types.StringValue("update")
 	config.ID = oldStateConfig.ID
+	config.ResultJSON = oldStateConfig.ResultJSON
+	config.Stderr = oldStateConfig.Stderr
+	config.ExitCode = oldStateConfig.ExitCode
+	config.DurationMs = oldStateConfig.DurationMs
+	config.LastRunAt = oldStateConfig.LastRunAt
+
+	// After an update was rolled back, the program is given the inputs the rollback restored as the prior state
+	rolledBack, diags := req.Private.GetKey(ctx, rolledBackStateKey)
+	resp.Diagnostics.Append(diags...)
+	resp.Diagnostics.Append(oldStateConfig.restoreInputs(ctx, rolledBack)...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
 
 	// Get the old result from the state
-	var oldResult map[string]types.String
-	diags = oldStateConfig.Result.ElementsAs(ctx, &oldResult, false)
+	oldResult, oldSensitiveResult, diags := oldStateConfig.results(ctx)
+	resp.Diagnostics.Append(diags...)
 	if resp.Diagnostics.HasError() {
 		return
 	}
-	if oldResult == nil {
-		oldResult = make(map[string]types.String)
+	oldPrivate, diags := req.Private.GetKey(ctx, privateStateKey)
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
 	}
-	result, errors := run_external(ctx, config, oldResult)
+	output, errors := e.run(ctx, config, oldResult, oldSensitiveResult, oldPrivate, &oldStateConfig)
 
-	if errors != nil {
+	if !output.Failed {
 		resp.Diagnostics.Append(errors...)
-		return
+		resp.Diagnostics.Append(output.Rollback...)
+		if errors.HasError() {
+			return
+		}
 	}
 
-	config.Result = result
+	config.setOutput(output)
+	resp.Diagnostics.Append(config.setFailure(output, errors)...)
+	resp.Diagnostics.Append(output.Rollback...)
+
+	// A rolled back update leaves the object as the prior state describes it, the next plan applies the update again
+	restored := []byte("null")
+	if output.Failed && len(output.Rollback) > 0 && !output.Rollback.HasError() {
+		config.Result, config.SensitiveResult, config.ResultJSON = oldStateConfig.Result, oldStateConfig.SensitiveResult, oldStateConfig.ResultJSON
+		output.Private = oldPrivate
+		restored, diags = oldStateConfig.rolledBackInputs(ctx)
+		resp.Diagnostics.Append(diags...)
+	}
+	if rolledBack != nil || string(restored) != "null" {
+		resp.Diagnostics.Append(resp.Private.SetKey(ctx, rolledBackStateKey, restored)...)
+	}
+	if output.Private != nil {
+		resp.Diagnostics.Append(resp.Private.SetKey(ctx, privateStateKey, output.Private)...)
+	}
 
 	diags = resp.State.Set(ctx, &config)
 	// Set Terraform state
@@ -260,22 +968,34 @@ func (e *externalResource) Read(ctx context.Context, req resource.ReadRequest, r
 	oldStateConfig.Stage = types.StringValue("read")
 
 	// Get the old result from the state
-	var oldResult map[string]types.String
-	diags = oldStateConfig.Result.ElementsAs(ctx, &oldResult, false)
+	oldResult, oldSensitiveResult, diags := oldStateConfig.results(ctx)
+	resp.Diagnostics.Append(diags...)
 	if resp.Diagnostics.HasError() {
 		return
 	}
-	if oldResult == nil {
-		oldResult = make(map[string]types.String)
+	oldPrivate, diags := req.Private.GetKey(ctx, privateStateKey)
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
 	}
-	result, errors := run_external(ctx, oldStateConfig, oldResult)
+	output, errors := e.run(ctx, oldStateConfig, oldResult, oldSensitiveResult, oldPrivate, &oldStateConfig)
 
-	if errors != nil {
-		resp.Diagnostics.Append(errors...)
+	resp.Diagnostics.Append(errors...)
+	if errors.HasError() {
+		return
+	}
+
+	// The program reported that the object is gone, so the next plan recreates it
+	if !output.Exists {
+		tflog.Info(ctx, "External program reported that the resource no longer exists, removing it from state")
+		resp.State.RemoveResource(ctx)
 		return
 	}
 
-	oldStateConfig.Result = result
+	oldStateConfig.setOutput(output)
+	if output.Private != nil {
+		resp.Diagnostics.Append(resp.Private.SetKey(ctx, privateStateKey, output.Private)...)
+	}
 
 	diags = resp.State.Set(ctx, &oldStateConfig)
 	// Set Terraform state
@@ -297,34 +1017,871 @@ func (e *externalResource) Delete(ctx context.Context, req resource.DeleteReques
 	oldStateConfig.Stage = types.StringValue("delete")
 
 	// Get the old result from the state
-	var oldResult map[string]types.String
-	diags = oldStateConfig.Result.ElementsAs(ctx, &oldResult, false)
+	oldResult, oldSensitiveResult, diags := oldStateConfig.results(ctx)
+	resp.Diagnostics.Append(diags...)
 	if resp.Diagnostics.HasError() {
 		return
 	}
-	if oldResult == nil {
-		oldResult = make(map[string]types.String)
+	oldPrivate, diags := req.Private.GetKey(ctx, privateStateKey)
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
 	}
-	result, errors := run_external(ctx, oldStateConfig, oldResult)
-
-	if errors != nil {
-		resp.Diagnostics.Append(errors...)
+	_, errors := e.run(ctx, oldStateConfig, oldResult, oldSensitiveResult, oldPrivate, &oldStateConfig)
+
+	// The resource can be forgotten when the program fails, for example when the host it tears down is long gone
+	if errors.HasError() && oldStateConfig.OnDeleteFailure.ValueString() == onDeleteFailureWarnAndForget {
+		resp.Diagnostics.Append(asWarnings(errors)...)
+		resp.Diagnostics.AddWarning(
+			"External Program Delete Failed",
+			"The program failed to delete the resource and it was removed from the state anyway, as configured "+
+				"with `on_delete_failure = \"warn_and_forget\"`. Whatever the program manages may still exist.",
+		)
 		return
 	}
-	oldStateConfig.Result = result
-	diags = resp.State.Set(ctx, &oldStateConfig)
-	// Set Terraform state
-	resp.Diagnostics.Append(resp.State.Set(ctx, &oldStateConfig)...)
-}
-
-func run_external(ctx context.Context, config externalResourceModelV0, oldResult map[string]types.String) (types.Map, diag.Diagnostics) {
-	tflog.Debug(ctx, "Running external program")
 
-	var diag diag.Diagnostics
+	// The resource is removed from the state when no error is returned
+	resp.Diagnostics.Append(errors...)
+}
 
-	//initMap := make(map[string]string)
-	initMap := map[string]string{}
-	emptyMap, _ := types.MapValueFrom(ctx, types.StringType, initMap)
+// ImportState runs the program with the `import` stage to adopt existing infrastructure. The import ID is a JSON
+// document with the program, query and working directory, and the program output becomes the result.
+func (e *externalResource) ImportState(ctx context.Context, req resource.ImportStateRequest, resp *resource.ImportStateResponse) {
+	tflog.Debug(ctx, "Importing resource")
+
+	var importID externalImportID
+	decoder := json.NewDecoder(strings.NewReader(req.ID))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&importID); err != nil {
+		resp.Diagnostics.AddError(
+			"Invalid Import ID",
+			"The import ID must be a JSON object with the keys \"program\", \"query\" and \"working_dir\", for example: "+
+				`{"program": ["bash", "import.sh"], "query": {"name": "value"}, "working_dir": "/opt/scripts"}`+
+				fmt.Sprintf("\n\nError: %s", err),
+		)
+		return
+	}
+
+	program, diags := types.ListValueFrom(ctx, types.StringType, importID.Program)
+	resp.Diagnostics.Append(diags...)
+	query := types.MapNull(types.StringType)
+	if importID.Query != nil {
+		query, diags = types.MapValueFrom(ctx, types.StringType, importID.Query)
+		resp.Diagnostics.Append(diags...)
+	}
+	if resp.Diagnostics.HasError() {
+		return
+	}
+	workingDir := types.StringNull()
+	if importID.WorkingDir != "" {
+		workingDir = types.StringValue(importID.WorkingDir)
+	}
+
+	// Everything which is not part of the import ID takes the value of an unset attribute
+	config := externalResourceModelV0{
+		Program:                 program,
+		CreateProgram:           types.ListNull(types.StringType),
+		ReadProgram:             types.ListNull(types.StringType),
+		UpdateProgram:           types.ListNull(types.StringType),
+		DeleteProgram:           types.ListNull(types.StringType),
+		PlanProgram:             types.ListNull(types.StringType),
+		RollbackProgram:         types.ListNull(types.StringType),
+		Create:                  types.BoolValue(true),
+		Read:                    types.BoolValue(false),
+		Update:                  types.BoolValue(false),
+		Delete:                  types.BoolValue(false),
+		Plan:                    types.BoolNull(),
+		WorkingDir:              workingDir,
+		Recreate:                types.MapNull(types.StringType),
+		Query:                   query,
+		Input:                   types.StringNull(),
+		QueryEncoding:           types.StringNull(),
+		Stage:                   types.StringValue("import"),
+		ID:                      types.StringValue("-"),
+		ResultJSON:              types.StringValue("{}"),
+		LockName:                types.StringNull(),
+		LockFile:                types.StringNull(),
+		LockTimeout:             types.StringNull(),
+		OnFailure:               types.StringNull(),
+		LastError:               types.StringNull(),
+		OnDeleteFailure:         types.StringNull(),
+		LogStdout:               types.BoolNull(),
+		CaptureOutput:           types.BoolNull(),
+		CaptureMaxBytes:         types.Int64Null(),
+		Stderr:                  types.StringNull(),
+		ExitCode:                types.Int64Null(),
+		DurationMs:              types.Int64Null(),
+		LastRunAt:               types.StringNull(),
+		SensitiveQuery:          types.MapNull(types.StringType),
+		SensitiveResultKeys:     types.ListNull(types.StringType),
+		Environment:             types.MapNull(types.StringType),
+		SensitiveEnvironment:    types.MapNull(types.StringType),
+		InheritEnvironment:      types.StringNull(),
+		InheritEnvironmentNames: types.ListNull(types.StringType),
+	}
+
+	output, errors := e.run(ctx, config, make(map[string]types.String), make(map[string]types.String), nil, nil)
+
+	resp.Diagnostics.Append(errors...)
+	if errors.HasError() {
+		return
+	}
+
+	if !output.Exists {
+		resp.Diagnostics.AddError(
+			"Cannot Import Non-Existent Resource",
+			"The program reported through the reserved key __exists that the object to import does not exist."+
+				fmt.Sprintf("\n\nImport ID: %s", req.ID),
+		)
+		return
+	}
+
+	config.setOutput(output)
+	if !output.ID.IsNull() {
+		config.ID = output.ID
+	}
+	if output.Private != nil {
+		resp.Diagnostics.Append(resp.Private.SetKey(ctx, privateStateKey, output.Private)...)
+	}
+
+	resp.Diagnostics.Append(resp.State.Set(ctx, &config)...)
+}
+
+// ModifyPlan runs the program with the `plan` stage when it is enabled and the resource changes. The program can
+// predict the result, require the resource to be replaced and report warnings. The details of the run are planned
+// as null when they are not captured.
+func (e *externalResource) ModifyPlan(ctx context.Context, req resource.ModifyPlanRequest, resp *resource.ModifyPlanResponse) {
+	if req.Plan.Raw.IsNull() {
+		return
+	}
+
+	// Stage flags which are not configured take the defaults of the provider configuration
+	resp.Diagnostics.Append(e.defaults.planStageFlags(ctx, req.Config, &resp.Plan)...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	// The configuration is validated again with the defaults of the provider
+	var config externalResourceModelV0
+	resp.Diagnostics.Append(req.Config.Get(ctx, &config)...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+	resp.Diagnostics.Append(e.defaults.validateDefaults(ctx, config)...)
+
+	// Programs which the execution policy of the provider does not allow fail the plan, before anything runs
+	for _, attribute := range programAttributes {
+		var program types.List
+		resp.Diagnostics.Append(req.Config.GetAttribute(ctx, path.Root(attribute), &program)...)
+		resp.Diagnostics.Append(e.defaults.checkProgram(ctx, program, config.WorkingDir, path.Root(attribute))...)
+	}
+	resp.Diagnostics.Append(e.defaults.checkEnvironment(config)...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	// A resource saved after a failure with on_failure = "taint" is replaced, even when nothing changed
+	if !req.State.Raw.IsNull() {
+		var lastError, onFailure types.String
+		resp.Diagnostics.Append(req.State.GetAttribute(ctx, path.Root("last_error"), &lastError)...)
+		resp.Diagnostics.Append(req.Plan.GetAttribute(ctx, path.Root("on_failure"), &onFailure)...)
+		if resp.Diagnostics.HasError() {
+			return
+		}
+		if !lastError.IsNull() && onFailure.ValueString() == onFailureTaint {
+			resp.RequiresReplace = append(resp.RequiresReplace, path.Root("last_error"))
+			resp.Diagnostics.Append(resp.Plan.SetAttribute(ctx, path.Root("last_error"), types.StringUnknown())...)
+		}
+
+		// An update which was rolled back is applied again, even when nothing changed since
+		rolledBack, diags := req.Private.GetKey(ctx, rolledBackStateKey)
+		resp.Diagnostics.Append(diags...)
+		if resp.Diagnostics.HasError() {
+			return
+		}
+		if isRolledBack(rolledBack) {
+			resp.Diagnostics.Append(resp.Plan.SetAttribute(ctx, path.Root("last_error"), types.StringUnknown())...)
+		}
+	}
+
+	// Nothing to predict when the resource does not change
+	if !req.State.Raw.IsNull() && resp.Plan.Raw.Equal(req.State.Raw) {
+		return
+	}
+
+	var plan externalResourceModelV0
+	resp.Diagnostics.Append(resp.Plan.Get(ctx, &plan)...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	// The details of the run are only known after apply when they are captured
+	if !plan.CaptureOutput.IsUnknown() && !plan.CaptureOutput.ValueBool() {
+		resp.Diagnostics.Append(resp.Plan.SetAttribute(ctx, path.Root("stderr"), types.StringNull())...)
+		resp.Diagnostics.Append(resp.Plan.SetAttribute(ctx, path.Root("exit_code"), types.Int64Null())...)
+		resp.Diagnostics.Append(resp.Plan.SetAttribute(ctx, path.Root("duration_ms"), types.Int64Null())...)
+		resp.Diagnostics.Append(resp.Plan.SetAttribute(ctx, path.Root("last_run_at"), types.StringNull())...)
+	}
+
+	// Errors are only recorded when a failure keeps the resource
+	if !plan.OnFailure.IsUnknown() && plan.OnFailure.ValueString() != onFailureContinue && plan.OnFailure.ValueString() != onFailureTaint {
+		resp.Diagnostics.Append(resp.Plan.SetAttribute(ctx, path.Root("last_error"), types.StringNull())...)
+	}
+
+	planEnabled := plan.Plan
+	if planEnabled.IsNull() && e.defaults != nil {
+		planEnabled = e.defaults.Plan
+	}
+	if planEnabled.IsUnknown() || !planEnabled.ValueBool() {
+		return
+	}
+	// An update stage which is not configured is only known to be disabled once the defaults are planned
+	if !plan.Update.IsUnknown() && !plan.Update.ValueBool() {
+		resp.Diagnostics.Append(planWithoutUpdate())
+		return
+	}
+
+	// The program can only be given its input once every value of the configuration is known
+	if !req.Config.Raw.IsFullyKnown() || !e.defaults.fullyKnown() {
+		tflog.Debug(ctx, "Skipping the plan stage, the configuration contains unknown values")
+		return
+	}
+
+	tflog.Debug(ctx, "Planning resource")
+	oldResult := make(map[string]types.String)
+	oldSensitiveResult := make(map[string]types.String)
+	// The prior state is passed like to the update stage which would follow, so the program knows what changed
+	var oldConfig *externalResourceModelV0
+	if !req.State.Raw.IsNull() {
+		var oldStateConfig externalResourceModelV0
+		resp.Diagnostics.Append(req.State.Get(ctx, &oldStateConfig)...)
+		rolledBack, diags := req.Private.GetKey(ctx, rolledBackStateKey)
+		resp.Diagnostics.Append(diags...)
+		resp.Diagnostics.Append(oldStateConfig.restoreInputs(ctx, rolledBack)...)
+		if resp.Diagnostics.HasError() {
+			return
+		}
+		oldResult, oldSensitiveResult, diags = oldStateConfig.results(ctx)
+		resp.Diagnostics.Append(diags...)
+		if resp.Diagnostics.HasError() {
+			return
+		}
+		plan.ResultJSON = oldStateConfig.ResultJSON
+		oldConfig = &oldStateConfig
+	}
+
+	// The private data returned by the plan stage is not stored, the apply stages return their own
+	oldPrivate, diags := req.Private.GetKey(ctx, privateStateKey)
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	plan.Stage = types.StringValue("plan")
+	output, errors := e.run(ctx, plan, oldResult, oldSensitiveResult, oldPrivate, oldConfig)
+
+	resp.Diagnostics.Append(errors...)
+	if errors.HasError() {
+		return
+	}
+
+	for _, warning := range output.Warnings {
+		resp.Diagnostics.AddAttributeWarning(path.Root("plan"), "External Program Plan Warning", warning)
+	}
+
+	// The result is only known after the replacement, which makes it differ from the state
+	if output.RequiresReplace && !req.State.Raw.IsNull() {
+		resp.RequiresReplace = append(resp.RequiresReplace, path.Root("result"))
+		resp.Diagnostics.Append(resp.Plan.SetAttribute(ctx, path.Root("result"), types.MapUnknown(types.StringType))...)
+		resp.Diagnostics.Append(resp.Plan.SetAttribute(ctx, path.Root("sensitive_result"), types.MapUnknown(types.StringType))...)
+		resp.Diagnostics.Append(resp.Plan.SetAttribute(ctx, path.Root("result_json"), types.StringUnknown())...)
+		return
+	}
+
+	// A predicted result must match what the create or update stage returns, so the program must ask for its
+	// result to be used: a program ignoring the stage would otherwise predict the query it echoes
+	if output.Predicted {
+		resp.Diagnostics.Append(resp.Plan.SetAttribute(ctx, path.Root("result"), output.Result)...)
+		resp.Diagnostics.Append(resp.Plan.SetAttribute(ctx, path.Root("sensitive_result"), output.SensitiveResult)...)
+		resp.Diagnostics.Append(resp.Plan.SetAttribute(ctx, path.Root("result_json"), output.ResultJSON)...)
+	}
+}
+
+// planWithoutUpdate is reported when the plan stage is enabled without the update stage, which keeps the previous
+// result after an update, so a predicted result would be reported by Terraform as inconsistent.
+func planWithoutUpdate() diag.Diagnostic {
+	return diag.NewAttributeErrorDiagnostic(path.Root("plan"),
+		"Plan Stage Without Update Stage",
+		"The resource was configured with the plan stage enabled but the update stage disabled. The result "+
+			"predicted by the plan stage must match the result after the update, which the program does not run for. "+
+			"Set `update = true` or disable `plan`.",
+	)
+}
+
+// stageEnabled returns the crud flag controlling whether the program runs for the given stage.
+func (m externalResourceModelV0) stageEnabled(stage string) types.Bool {
+	switch stage {
+	case "create":
+		return m.Create
+	case "read":
+		return m.Read
+	case "update":
+		return m.Update
+	case "delete":
+		return m.Delete
+	case "plan":
+		return m.Plan
+	default:
+		return types.BoolNull()
+	}
+}
+
+// stageProgram returns the program to run for the given stage along with the path of the attribute it was
+// read from. A stage specific program takes precedence over the shared `program` attribute.
+func (m externalResourceModelV0) stageProgram(stage string) (types.List, path.Path) {
+	var program types.List
+	switch stage {
+	case "create":
+		program = m.CreateProgram
+	case "read":
+		program = m.ReadProgram
+	case "update":
+		program = m.UpdateProgram
+	case "delete":
+		program = m.DeleteProgram
+	case "plan":
+		program = m.PlanProgram
+	}
+	if program.IsNull() {
+		return m.Program, path.Root("program")
+	}
+	return program, path.Root(stage + "_program")
+}
+
+// programArgs returns the program and its arguments without the null and empty values, and whether every value
+// is known. A program which is not known yet has no arguments.
+func programArgs(program types.List) ([]string, bool) {
+	if program.IsUnknown() {
+		return nil, false
+	}
+	args := make([]string, 0, len(program.Elements()))
+	for _, element := range program.Elements() {
+		arg, ok := element.(types.String)
+		if !ok {
+			continue
+		}
+		if arg.IsUnknown() {
+			return nil, false
+		}
+		if arg.IsNull() || arg.ValueString() == "" {
+			continue
+		}
+		args = append(args, arg.ValueString())
+	}
+	return args, true
+}
+
+// stageTimeout returns the time limit of the program for the given stage, zero when it has no limit, and the
+// grace period given to the program after SIGTERM.
+func (m externalResourceModelV0) stageTimeout(stage string) (time.Duration, time.Duration, error) {
+	if m.Timeouts == nil {
+		return 0, defaultGracePeriod, nil
+	}
+
+	var timeout types.String
+	switch stage {
+	case "create":
+		timeout = m.Timeouts.Create
+	case "read":
+		timeout = m.Timeouts.Read
+	case "update":
+		timeout = m.Timeouts.Update
+	case "delete":
+		timeout = m.Timeouts.Delete
+	case "plan":
+		timeout = m.Timeouts.Plan
+	}
+
+	var limit time.Duration
+	if !timeout.IsNull() && !timeout.IsUnknown() {
+		var err error
+		limit, err = time.ParseDuration(timeout.ValueString())
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	gracePeriod := defaultGracePeriod
+	if !m.Timeouts.GracePeriod.IsNull() && !m.Timeouts.GracePeriod.IsUnknown() {
+		var err error
+		gracePeriod, err = time.ParseDuration(m.Timeouts.GracePeriod.ValueString())
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	return limit, gracePeriod, nil
+}
+
+// stageRetry returns the retry policy of the stage, which runs the program a single time without a retry block or
+// when the stage is not retried.
+func (m externalResourceModelV0) stageRetry(ctx context.Context, stage string) (retryPolicy, error) {
+	if m.Retry == nil {
+		return noRetry, nil
+	}
+
+	if !m.Retry.Stages.IsNull() {
+		var stages []string
+		if diags := m.Retry.Stages.ElementsAs(ctx, &stages, false); diags.HasError() {
+			return noRetry, fmt.Errorf("invalid stages: %v", diags)
+		}
+		enabled := false
+		for _, retryStage := range stages {
+			enabled = enabled || retryStage == stage
+		}
+		if !enabled {
+			return noRetry, nil
+		}
+	}
+
+	policy := retryPolicy{
+		MaxAttempts:    defaultRetryMaxAttempts,
+		InitialBackoff: defaultRetryInitialBackoff,
+		MaxBackoff:     defaultRetryMaxBackoff,
+		ExitCodes:      map[int]bool{},
+	}
+	if !m.Retry.MaxAttempts.IsNull() {
+		policy.MaxAttempts = int(m.Retry.MaxAttempts.ValueInt64())
+	}
+	var err error
+	if !m.Retry.InitialBackoff.IsNull() {
+		if policy.InitialBackoff, err = time.ParseDuration(m.Retry.InitialBackoff.ValueString()); err != nil {
+			return noRetry, err
+		}
+	}
+	if !m.Retry.MaxBackoff.IsNull() {
+		if policy.MaxBackoff, err = time.ParseDuration(m.Retry.MaxBackoff.ValueString()); err != nil {
+			return noRetry, err
+		}
+	}
+
+	var exitCodes []int64
+	if diags := m.Retry.RetryableExitCodes.ElementsAs(ctx, &exitCodes, false); diags.HasError() {
+		return noRetry, fmt.Errorf("invalid retryable_exit_codes: %v", diags)
+	}
+	for _, exitCode := range exitCodes {
+		policy.ExitCodes[int(exitCode)] = true
+	}
+	var patterns []string
+	if diags := m.Retry.RetryableStderrPatterns.ElementsAs(ctx, &patterns, false); diags.HasError() {
+		return noRetry, fmt.Errorf("invalid retryable_stderr_patterns: %v", diags)
+	}
+	for _, pattern := range patterns {
+		expression, err := regexp.Compile(pattern)
+		if err != nil {
+			return noRetry, err
+		}
+		policy.StderrPatterns = append(policy.StderrPatterns, expression)
+	}
+
+	return policy, nil
+}
+
+// programEnvironment returns the environment of the program: the variables inherited from Terraform according
+// to `inherit_environment`, overridden by `environment` and then `sensitive_environment`.
+func (m externalResourceModelV0) programEnvironment(ctx context.Context) ([]string, diag.Diagnostics) {
+	var diags diag.Diagnostics
+	environment := map[string]string{}
+
+	switch m.InheritEnvironment.ValueString() {
+	case inheritEnvironmentNone:
+	case inheritEnvironmentAllowlist:
+		var names []types.String
+		diags.Append(m.InheritEnvironmentNames.ElementsAs(ctx, &names, false)...)
+		if diags.HasError() {
+			return nil, diags
+		}
+		for _, name := range names {
+			if value, ok := os.LookupEnv(name.ValueString()); ok {
+				environment[name.ValueString()] = value
+			}
+		}
+	default:
+		// Without a mode, which includes states written before inherit_environment existed, inherit everything
+		for _, variable := range os.Environ() {
+			name, value, _ := strings.Cut(variable, "=")
+			environment[name] = value
+		}
+	}
+
+	for _, variables := range []types.Map{m.Environment, m.SensitiveEnvironment} {
+		var values map[string]types.String
+		diags.Append(variables.ElementsAs(ctx, &values, false)...)
+		if diags.HasError() {
+			return nil, diags
+		}
+		for name, value := range values {
+			if value.IsNull() {
+				delete(environment, name)
+				continue
+			}
+			environment[name] = value.ValueString()
+		}
+	}
+
+	names := make([]string, 0, len(environment))
+	for name := range environment {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	env := make([]string, 0, len(names))
+	for _, name := range names {
+		env = append(env, name+"="+environment[name])
+	}
+	return env, diags
+}
+
+// reservedQueryKey returns whether the key is set by the provider in the JSON object passed to the program, so it
+// can not be a key of query or sensitive_query. `input` is only reserved when the input attribute is set.
+func (m externalResourceModelV0) reservedQueryKey(key string) bool {
+	return reservedQueryKeys[key] || key == "input" && !m.Input.IsNull()
+}
+
+// results returns the result and sensitive result stored in the state, or empty maps when they are not set.
+func (m externalResourceModelV0) results(ctx context.Context) (map[string]types.String, map[string]types.String, diag.Diagnostics) {
+	var diags diag.Diagnostics
+	result := map[string]types.String{}
+	sensitiveResult := map[string]types.String{}
+
+	diags.Append(m.Result.ElementsAs(ctx, &result, false)...)
+	diags.Append(m.SensitiveResult.ElementsAs(ctx, &sensitiveResult, false)...)
+	return result, sensitiveResult, diags
+}
+
+// setOutput stores the values returned by the program for a stage.
+func (m *externalResourceModelV0) setOutput(output externalOutput) {
+	m.Result = output.Result
+	m.SensitiveResult = output.SensitiveResult
+	m.ResultJSON = output.ResultJSON
+	m.Stderr = output.Stderr
+	m.ExitCode = output.ExitCode
+	m.DurationMs = output.DurationMs
+	m.LastRunAt = output.LastRunAt
+}
+
+// setFailure records the failure of the program on create or update according to `on_failure` and returns the
+// diagnostics to report: the errors of the failure, as warnings with `continue`. The last error is cleared when the
+// program succeeded.
+func (m *externalResourceModelV0) setFailure(output externalOutput, errors diag.Diagnostics) diag.Diagnostics {
+	m.LastError = types.StringNull()
+	if !output.Failed {
+		return nil
+	}
+
+	m.LastError = types.StringValue(errorSummary(errors))
+
+	if m.OnFailure.ValueString() == onFailureContinue {
+		return asWarnings(errors)
+	}
+	return errors
+}
+
+// errorSummary returns the summary and detail of every error, separated by blank lines.
+func errorSummary(diags diag.Diagnostics) string {
+	var messages []string
+	for _, diagnostic := range diags.Errors() {
+		messages = append(messages, fmt.Sprintf("%s: %s", diagnostic.Summary(), diagnostic.Detail()))
+	}
+	return strings.Join(messages, "\n\n")
+}
+
+// asWarnings returns the diagnostics with every error turned into a warning on the same attribute.
+func asWarnings(diags diag.Diagnostics) diag.Diagnostics {
+	var warnings diag.Diagnostics
+	for _, diagnostic := range diags {
+		if diagnostic.Severity() != diag.SeverityError {
+			warnings.Append(diagnostic)
+			continue
+		}
+		if withPath, ok := diagnostic.(diag.DiagnosticWithPath); ok {
+			warnings.AddAttributeWarning(withPath.Path(), diagnostic.Summary(), diagnostic.Detail())
+			continue
+		}
+		warnings.AddWarning(diagnostic.Summary(), diagnostic.Detail())
+	}
+	return warnings
+}
+
+// toleratesFailure returns whether a failure of the program on the stage keeps what it returned, which
+// `on_failure` allows on create and update.
+func (m externalResourceModelV0) toleratesFailure(stage string) bool {
+	if stage != "create" && stage != "update" {
+		return false
+	}
+	return m.OnFailure.ValueString() == onFailureContinue || m.OnFailure.ValueString() == onFailureTaint
+}
+
+// sensitiveValues returns the non-empty values of the given maps, which must be kept out of logs and diagnostics.
+func sensitiveValues(values ...map[string]types.String) []string {
+	var secrets []string
+	for _, m := range values {
+		for _, value := range m {
+			if value.ValueString() != "" {
+				secrets = append(secrets, value.ValueString())
+			}
+		}
+	}
+	return secrets
+}
+
+// redact replaces every secret in text so it can be safely used in diagnostics.
+func redact(text string, secrets []string) string {
+	for _, secret := range secrets {
+		text = strings.ReplaceAll(text, secret, "***")
+	}
+	return text
+}
+
+// runFailure returns the diagnostics of a failed run of the program. The errors reported by the program through
+// `__diagnostics` explain the failure better than its stderr, unless it timed out.
+func runFailure(run externalRun, reported diag.Diagnostics, stage string, timeout time.Duration, gracePeriod time.Duration, programPath path.Path, secrets []string, attempts string) diag.Diagnostics {
+	var diags diag.Diagnostics
+	cmd, err, stderr := run.Cmd, run.Err, run.Stderr
+
+	if run.TimedOut {
+		diags.AddAttributeError(
+			path.Root("timeouts"),
+			"External Program Timed Out",
+			fmt.Sprintf("The program did not complete the %s stage within the configured timeout of %s. ", stage, timeout)+
+				fmt.Sprintf("Its process group was sent SIGTERM and killed if still running after the %s grace period.", gracePeriod)+
+				fmt.Sprintf("\n\nProgram: %s", cmd.Path)+
+				fmt.Sprintf("\nState: %s", err)+
+				attempts,
+		)
+		return diags
+	}
+
+	diags.Append(reported...)
+	if reported.HasError() {
+		return diags
+	}
+	if _, ok := err.(*exec.ExitError); ok {
+		if errorMessage := stderr.Text(maxStderrBytes, secrets); len(errorMessage) > 0 {
+			diags.AddAttributeError(
+				programPath,
+				"External Program Execution Failed",
+				"The resource received an unexpected error while attempting to execute the program."+
+					fmt.Sprintf("\n\nProgram: %s", cmd.Path)+
+					fmt.Sprintf("\nError Message: %s", errorMessage)+
+					fmt.Sprintf("\nState: %s", err)+
+					attempts,
+			)
+			return diags
+		}
+
+		diags.AddAttributeError(
+			programPath,
+			"External Program Execution Failed",
+			"The resource received an unexpected error while attempting to execute the program.\n\n"+
+				"The program was executed, however it returned no additional error messaging."+
+				fmt.Sprintf("\n\nProgram: %s", cmd.Path)+
+				fmt.Sprintf("\nState: %s", err)+
+				attempts,
+		)
+		return diags
+	}
+
+	diags.AddAttributeError(
+		programPath,
+		"External Program Execution Failed",
+		"The resource received an unexpected error while attempting to execute the program."+
+			fmt.Sprintf("\n\nProgram: %s", cmd.Path)+
+			fmt.Sprintf("\nError: %s", err),
+	)
+	return diags
+}
+
+// programDiagnostic is an entry of the reserved `__diagnostics` key returned by the program.
+type programDiagnostic struct {
+	Severity string `json:"severity"`
+	Summary  string `json:"summary"`
+	Detail   string `json:"detail"`
+	QueryKey string `json:"query_key"`
+}
+
+// programDiagnostics converts the value of the reserved `__diagnostics` key to Terraform diagnostics. Diagnostics
+// with a query key are reported on that key of `query` or `sensitive_query`, the others on the program.
+func programDiagnostics(value any, query map[string]types.String, sensitiveQuery map[string]types.String, programPath path.Path, secrets []string) (diag.Diagnostics, error) {
+	var diags diag.Diagnostics
+	if value == nil {
+		return diags, nil
+	}
+
+	// Round trip through JSON to decode the entries into their struct
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	var entries []programDiagnostic
+	decoder := json.NewDecoder(bytes.NewReader(encoded))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&entries); err != nil {
+		return nil, fmt.Errorf("expected a list of objects with the keys severity, summary, detail and query_key: %w", err)
+	}
+
+	for i, entry := range entries {
+		if entry.Summary == "" {
+			return nil, fmt.Errorf("entry %d has no summary", i)
+		}
+		attributePath := programPath
+		if entry.QueryKey != "" {
+			if _, ok := sensitiveQuery[entry.QueryKey]; ok {
+				attributePath = path.Root("sensitive_query").AtMapKey(entry.QueryKey)
+			} else if _, ok := query[entry.QueryKey]; ok {
+				attributePath = path.Root("query").AtMapKey(entry.QueryKey)
+			} else {
+				return nil, fmt.Errorf("entry %d refers to the query key %q which is not configured", i, entry.QueryKey)
+			}
+		}
+
+		summary, detail := redact(entry.Summary, secrets), redact(entry.Detail, secrets)
+		switch entry.Severity {
+		case "error":
+			diags.AddAttributeError(attributePath, summary, detail)
+		case "warning":
+			diags.AddAttributeWarning(attributePath, summary, detail)
+		default:
+			return nil, fmt.Errorf("entry %d has the severity %q, expected \"error\" or \"warning\"", i, entry.Severity)
+		}
+	}
+	return diags, nil
+}
+
+// changedKeys returns the sorted keys which were added, removed or changed between the old and the new query.
+func changedKeys(oldQuery map[string]types.String, newQuery map[string]types.String) []string {
+	changed := []string{}
+	for key, value := range newQuery {
+		if oldValue, ok := oldQuery[key]; !ok || !oldValue.Equal(value) {
+			changed = append(changed, key)
+		}
+	}
+	for key := range oldQuery {
+		if _, ok := newQuery[key]; !ok {
+			changed = append(changed, key)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// decodeQueryValue converts a query value to the value passed to the program according to the query encoding.
+func decodeQueryValue(encoding string, value string) (any, error) {
+	if encoding == queryEncodingRaw {
+		return value, nil
+	}
+	var decoded any
+	if err := json.Unmarshal([]byte(value), &decoded); err != nil {
+		if encoding == queryEncodingJSON {
+			return nil, err
+		}
+		return value, nil
+	}
+	return decoded, nil
+}
+
+// decodeResultValue converts a value of the previous result to the value passed to the program in `old_result`.
+// Values which are not valid JSON are always passed as strings, as the program may return any string.
+func decodeResultValue(encoding string, value string) any {
+	if encoding == queryEncodingRaw {
+		return value
+	}
+	decoded, err := decodeQueryValue(queryEncodingAuto, value)
+	if err != nil {
+		return value
+	}
+	return decoded
+}
+
+// run runs the program of the stage with the defaults of the provider configuration applied to config and to the
+// prior state.
+func (e *externalResource) run(ctx context.Context, config externalResourceModelV0, oldResult map[string]types.String, oldSensitiveResult map[string]types.String, oldPrivate []byte, oldConfig *externalResourceModelV0) (externalOutput, diag.Diagnostics) {
+	diags := e.defaults.validateDefaults(ctx, config)
+	// Only the variables of the resource are restricted, not the ones of the provider configuration
+	environmentDiags := e.defaults.checkEnvironment(config)
+	config, applyDiags := e.defaults.apply(ctx, config)
+	diags.Append(applyDiags...)
+
+	// The execution policy is enforced again when the program runs, as read, delete and import are not planned
+	stage := config.Stage.ValueString()
+	execute := stage == "import" || config.stageEnabled(stage).ValueBool()
+	if execute {
+		diags.Append(environmentDiags...)
+		program, programPath := config.stageProgram(stage)
+		diags.Append(e.defaults.checkProgram(ctx, program, config.WorkingDir, programPath)...)
+		if stage == "update" {
+			diags.Append(e.defaults.checkProgram(ctx, config.RollbackProgram, config.WorkingDir, path.Root("rollback_program"))...)
+		}
+	}
+	if oldConfig != nil {
+		old, oldDiags := e.defaults.apply(ctx, *oldConfig)
+		diags.Append(oldDiags...)
+		oldConfig = &old
+	}
+	if diags.HasError() {
+		return externalOutput{}, diags
+	}
+
+	// The lock file is taken first, so waiting for another Terraform run does not keep the programs of this one
+	// waiting. Programs sharing a lock name then run one at a time, within the limit of programs running at once
+	if execute && !config.LockFile.IsNull() {
+		lock, lockDiags := config.lockFile(ctx)
+		diags.Append(lockDiags...)
+		if diags.HasError() {
+			return externalOutput{}, diags
+		}
+		defer func() {
+			if err := lock.release(); err != nil {
+				tflog.Warn(ctx, "Failed to release lock file", map[string]interface{}{"lock_file": config.LockFile.ValueString(), "error": err.Error()})
+			}
+		}()
+	}
+	if execute {
+		release, err := e.limiter.acquire(ctx, config.LockName.ValueString())
+		if err != nil {
+			diags.AddError(
+				"External Program Wait Cancelled",
+				fmt.Sprintf("The operation was cancelled while waiting for other programs to complete: %s", err),
+			)
+			return externalOutput{}, diags
+		}
+		defer release()
+	}
+
+	output, runDiags := run_external(ctx, config, oldResult, oldSensitiveResult, oldPrivate, oldConfig)
+	diags.Append(runDiags...)
+
+	// The failed update is rolled back before other programs sharing the lock can run
+	if stage == "update" && diags.HasError() && output.Run != nil && !config.RollbackProgram.IsNull() {
+		output.Rollback = config.rollback(ctx, *output.Run, diags, output.Secrets)
+	}
+	return output, diags
+}
+
+// run_external runs the program of the stage of config. oldConfig is the prior state, which is passed to the
+// program on plan, update, read and delete so it can tell what changed since the last apply.
+func run_external(ctx context.Context, config externalResourceModelV0, oldResult map[string]types.String, oldSensitiveResult map[string]types.String, oldPrivate []byte, oldConfig *externalResourceModelV0) (externalOutput, diag.Diagnostics) {
+	tflog.Debug(ctx, "Running external program")
+
+	var diag diag.Diagnostics
+
+	//initMap := make(map[string]string)
+	initMap := map[string]string{}
+	emptyMap, _ := types.MapValueFrom(ctx, types.StringType, initMap)
+	emptyOutput := externalOutput{
+		Result: emptyMap, SensitiveResult: emptyMap, ResultJSON: types.StringValue("{}"),
+		Stderr: types.StringNull(), ExitCode: types.Int64Null(), DurationMs: types.Int64Null(), LastRunAt: types.StringNull(),
+		Exists: true, ID: types.StringNull(),
+	}
 
 	stage := config.Stage.ValueString()
 	// Get the crud variable based on the stage so we know whether to execute the program
@@ -338,12 +1895,16 @@ func run_external(ctx context.Context, config externalResourceModelV0, oldResult
 		execute = config.Update.ValueBool()
 	case "delete":
 		execute = config.Delete.ValueBool()
+	case "plan":
+		execute = config.Plan.ValueBool()
+	case "import":
+		execute = true
 	default:
 		diag.AddAttributeError(path.Root("stage"),
 			"Invalid Stage",
 			fmt.Sprintf("The resource was configured with an invalid stage: %s", stage),
 		)
-		return emptyMap, diag
+		return emptyOutput, diag
 	}
 
 	// Check if the result is set and return it otherwise return the empty mapping when not executing
@@ -354,40 +1915,47 @@ func run_external(ctx context.Context, config externalResourceModelV0, oldResult
 				"Invalid old result",
 				fmt.Sprintf("The resource was configured with an invalid old result: %v", oldResult),
 			)
-			return emptyMap, diag
+			return emptyOutput, diag
+		}
+		oldSensitiveResultMap, err := types.MapValueFrom(ctx, types.StringType, oldSensitiveResult)
+		if err != nil {
+			diag.AddError(
+				"Invalid old result",
+				"The resource was configured with an invalid old sensitive result.",
+			)
+			return emptyOutput, diag
+		}
+		output := emptyOutput
+		output.Result = oldResultMap
+		output.SensitiveResult = oldSensitiveResultMap
+		// The typed result can not be rebuilt from the string values, so the previous one is kept
+		output.ResultJSON = config.ResultJSON
+		output.Private = oldPrivate
+		// The details of the previous run are kept while they are captured
+		if config.CaptureOutput.ValueBool() {
+			output.Stderr, output.ExitCode, output.DurationMs, output.LastRunAt = config.Stderr, config.ExitCode, config.DurationMs, config.LastRunAt
 		}
-		return oldResultMap, nil
+		return output, nil
 	}
 
 	// Setup program variable
-	// Grab program list and filter out empty/null values
-	var program []types.String
-	diag = config.Program.ElementsAs(ctx, &program, false)
-	if diag.HasError() {
-		return emptyMap, diag
-	}
-	filteredProgram := make([]string, 0, len(program))
-	for _, programArgRaw := range program {
-		if programArgRaw.IsNull() || programArgRaw.ValueString() == "" {
-			continue
-		}
-
-		filteredProgram = append(filteredProgram, programArgRaw.ValueString())
-	}
+	// Grab the stage program list and filter out empty/null values
+	stageProgram, programPath := config.stageProgram(stage)
+	filteredProgram, _ := programArgs(stageProgram)
 	if len(filteredProgram) == 0 {
-		diag.AddAttributeError(path.Root("program"),
+		diag.AddAttributeError(programPath,
 			"External Program Missing",
 			"The resource was configured without a program to execute. Verify the configuration contains at least one non-empty value.",
 		)
-		return emptyMap, diag
+		return emptyOutput, diag
 	}
 	// first element is assumed to be an executable command, possibly found
-	// using the PATH environment variable.
-	_, err := exec.LookPath(filteredProgram[0])
+	// using the PATH environment variable or relative to the working directory.
+	_, err := exec.LookPath(programLocation(filteredProgram[0], config.WorkingDir.ValueString()))
 
 	if err != nil {
 		diag.AddAttributeError(
-			path.Root("program"),
+			programPath,
 			"External Program Lookup Failed",
 			"The resource received an unexpected error while attempting to parse the query. "+
 				`The resource received an unexpected error while attempting to find the program.
@@ -401,10 +1969,10 @@ If the expected program is relative to the Terraform configuration, it is recomm
 The program must also be executable according to the platform where Terraform is running. On Unix-based platforms, the file on the filesystem must have the executable bit set. On Windows-based platforms, no action is typically necessary.
 `+
 				fmt.Sprintf("\nPlatform: %s", runtime.GOOS)+
-				fmt.Sprintf("\nProgram: %s", program[0])+
+				fmt.Sprintf("\nProgram: %s", filteredProgram[0])+
 				fmt.Sprintf("\nError: %s", err),
 		)
-		return emptyMap, diag
+		return emptyOutput, diag
 	}
 
 	// Setup the final value to pass to the program
@@ -416,46 +1984,155 @@ The program must also be executable according to the platform where Terraform is
 	// Setup query variable
 	diag = config.Query.ElementsAs(ctx, &query, false)
 	if diag.HasError() {
-		return emptyMap, diag
+		return emptyOutput, diag
 	}
 	if query == nil {
 		query = make(map[string]types.String)
 	}
-	// Check for reserved keys
-	for key, _ := range query {
-		if key == "stage" || key == "old_result" {
+	// Check for reserved keys again, the query of the provider configuration is only merged in when the program runs
+	for key := range query {
+		if config.reservedQueryKey(key) {
 			diag.AddAttributeError(path.Root("query"),
 				"Reserved Query Key",
 				fmt.Sprintf("The resource was configured with a reserved query key: %s", key),
 			)
-			return emptyMap, diag
+			return emptyOutput, diag
 		}
 	}
 
+	// Setup sensitive query variable, which is merged into the query
+	var sensitiveQuery map[string]types.String
+	diag = config.SensitiveQuery.ElementsAs(ctx, &sensitiveQuery, false)
+	if diag.HasError() {
+		return emptyOutput, diag
+	}
+	for key := range sensitiveQuery {
+		if config.reservedQueryKey(key) {
+			diag.AddAttributeError(path.Root("sensitive_query"),
+				"Reserved Query Key",
+				fmt.Sprintf("The resource was configured with a reserved query key: %s", key),
+			)
+			return emptyOutput, diag
+		}
+		if _, ok := query[key]; ok {
+			diag.AddAttributeError(path.Root("sensitive_query"),
+				"Duplicate Query Key",
+				fmt.Sprintf("The resource was configured with a key in both query and sensitive_query: %s", key),
+			)
+			return emptyOutput, diag
+		}
+	}
+
+	// Keys of the output stored in sensitive_result rather than result
+	var sensitiveResultKeys []types.String
+	diag = config.SensitiveResultKeys.ElementsAs(ctx, &sensitiveResultKeys, false)
+	if diag.HasError() {
+		return emptyOutput, diag
+	}
+	sensitiveKeys := map[string]bool{}
+	for key := range sensitiveQuery {
+		sensitiveKeys[key] = true
+	}
+	for _, key := range sensitiveResultKeys {
+		sensitiveKeys[key.ValueString()] = true
+	}
+
+	// Values of sensitive attributes are masked in the provider logs and redacted from diagnostics
+	var sensitiveEnvironment map[string]types.String
+	diag = config.SensitiveEnvironment.ElementsAs(ctx, &sensitiveEnvironment, false)
+	if diag.HasError() {
+		return emptyOutput, diag
+	}
+	// The query of the prior state, with its sensitive values merged in like the current query
+	var oldQuery, oldSensitiveQuery map[string]types.String
+	if oldConfig != nil {
+		diag = oldConfig.Query.ElementsAs(ctx, &oldQuery, false)
+		diag.Append(oldConfig.SensitiveQuery.ElementsAs(ctx, &oldSensitiveQuery, false)...)
+		if diag.HasError() {
+			return emptyOutput, diag
+		}
+	}
+	secrets := sensitiveValues(sensitiveQuery, oldSensitiveResult, sensitiveEnvironment, oldSensitiveQuery)
+	ctx = tflog.MaskLogStrings(ctx, secrets...)
+
 	// Maps must be converted to avoid json marshal dropping values
+	encoding := config.QueryEncoding.ValueString()
+	for key, value := range sensitiveQuery {
+		query[key] = value
+	}
 	for key, value := range query {
-		var new_value any
-		err = json.Unmarshal([]byte(value.ValueString()), &new_value)
+		new_value, err := decodeQueryValue(encoding, value.ValueString())
 		if err != nil {
-			filteredQuery[key] = value.ValueString()
-			continue
+			if _, ok := sensitiveQuery[key]; ok {
+				diag.AddAttributeError(path.Root("sensitive_query").AtMapKey(key),
+					"Invalid Query Value",
+					fmt.Sprintf("The value of the key %q is not valid JSON.", key),
+				)
+				return emptyOutput, diag
+			}
+			diag.AddAttributeError(path.Root("query").AtMapKey(key),
+				"Invalid Query Value",
+				fmt.Sprintf("The value of the key %q is not valid JSON: %s", key, err),
+			)
+			return emptyOutput, diag
 		}
 		filteredQuery[key] = new_value
 	}
 	convertedOldResult := map[string]any{}
 	for key, value := range oldResult {
-		var new_value any
-		err = json.Unmarshal([]byte(value.ValueString()), &new_value)
-		if err != nil {
+		convertedOldResult[key] = decodeResultValue(encoding, value.ValueString())
+	}
+	// The json encoding passes the previous result with the types the program returned, which only the typed
+	// result keeps. Sensitive values are not part of it and are passed as strings.
+	if encoding == queryEncodingJSON && !config.ResultJSON.IsNull() && !config.ResultJSON.IsUnknown() {
+		typedOldResult := map[string]any{}
+		if err := json.Unmarshal([]byte(config.ResultJSON.ValueString()), &typedOldResult); err == nil {
+			for key, value := range typedOldResult {
+				convertedOldResult[key] = value
+			}
+		}
+	}
+	for key, value := range oldSensitiveResult {
+		if encoding == queryEncodingJSON {
 			convertedOldResult[key] = value.ValueString()
 			continue
 		}
-		convertedOldResult[key] = new_value
+		convertedOldResult[key] = decodeResultValue(encoding, value.ValueString())
 	}
 
 	// Set stage and result in final query mapping
 	filteredQuery["old_result"] = convertedOldResult
 	filteredQuery["stage"] = stage
+	// The input is already JSON and is passed as is, keeping the types of its values
+	if !config.Input.IsNull() && !config.Input.IsUnknown() {
+		filteredQuery["input"] = json.RawMessage(config.Input.ValueString())
+	}
+	// The metadata of the resource, the id is only known once the create or import stage returned it
+	metadata := map[string]any{"old_private": map[string]any{}}
+	if oldPrivate != nil {
+		metadata["old_private"] = json.RawMessage(oldPrivate)
+	}
+	if stage != "create" && stage != "import" && !config.ID.IsNull() && !config.ID.IsUnknown() {
+		metadata["id"] = config.ID.ValueString()
+	}
+	// The prior configuration is passed as the program received it on the last apply
+	if oldConfig != nil {
+		mergedOldQuery := map[string]types.String{}
+		convertedOldQuery := map[string]any{}
+		for _, values := range []map[string]types.String{oldQuery, oldSensitiveQuery} {
+			for key, value := range values {
+				mergedOldQuery[key] = value
+				convertedOldQuery[key] = decodeResultValue(encoding, value.ValueString())
+			}
+		}
+		metadata["old_query"] = convertedOldQuery
+		metadata["old_working_dir"] = nil
+		if !oldConfig.WorkingDir.IsNull() {
+			metadata["old_working_dir"] = oldConfig.WorkingDir.ValueString()
+		}
+		metadata["changed_keys"] = changedKeys(mergedOldQuery, query)
+	}
+	filteredQuery[toolboxQueryKey] = metadata
 
 	queryJson, err := json.Marshal(filteredQuery)
 	if err != nil {
@@ -466,63 +2143,152 @@ The program must also be executable according to the platform where Terraform is
 				"This is always a bug in the external provider code and should be reported to the provider developers."+
 				fmt.Sprintf("\n\nError: %s", err),
 		)
-		return emptyMap, diag
+		return emptyOutput, diag
 	}
 
 	// Setup working directory
 	workingDir := config.WorkingDir.ValueString()
 
-	// Setup the command to run
-	cmd := exec.CommandContext(ctx, filteredProgram[0], filteredProgram[1:]...)
-	cmd.Dir = workingDir
-	cmd.Stdin = bytes.NewReader(queryJson)
-
-	tflog.Trace(ctx, "Executing external program", map[string]interface{}{"program": cmd.String()})
+	// Setup the environment of the program
+	env, envDiags := config.programEnvironment(ctx)
+	if envDiags.HasError() {
+		diag.Append(envDiags...)
+		return emptyOutput, diag
+	}
 
-	resultJson, err := cmd.Output()
+	// Setup the time limit of the stage
+	timeout, gracePeriod, err := config.stageTimeout(stage)
+	if err != nil {
+		diag.AddAttributeError(
+			path.Root("timeouts"),
+			"Invalid Timeout",
+			fmt.Sprintf("The resource was configured with an invalid timeout for the %s stage: %s", stage, err),
+		)
+		return emptyOutput, diag
+	}
+	policy, err := config.stageRetry(ctx, stage)
+	if err != nil {
+		diag.AddAttributeError(
+			path.Root("retry"),
+			"Invalid Retry Policy",
+			fmt.Sprintf("The resource was configured with an invalid retry policy: %s", err),
+		)
+		return emptyOutput, diag
+	}
 
-	tflog.Trace(ctx, "Executed external program", map[string]interface{}{"program": cmd.String(), "output": string(resultJson)})
+	captureMaxBytes := defaultCaptureMaxBytes
+	if !config.CaptureMaxBytes.IsNull() && !config.CaptureMaxBytes.IsUnknown() {
+		captureMaxBytes = int(config.CaptureMaxBytes.ValueInt64())
+	}
+	// stdout is never logged when the program may return sensitive values, which are only masked once it is parsed
+	command := externalCommand{
+		Program:     filteredProgram,
+		Dir:         workingDir,
+		Env:         env,
+		Stdin:       queryJson,
+		Stage:       stage,
+		Timeout:     timeout,
+		GracePeriod: gracePeriod,
+		StderrBytes: maxStderrBytes,
+		LogStdout:   config.LogStdout.ValueBool() && len(sensitiveKeys) == 0,
+		Secrets:     secrets,
+	}
+	if captureMaxBytes > maxStderrBytes {
+		command.StderrBytes = captureMaxBytes
+	}
 
-	if err != nil {
-		if exitErr, ok := err.(*exec.ExitError); ok {
-			if exitErr.Stderr != nil && len(exitErr.Stderr) > 0 {
-				diag.AddAttributeError(
-					path.Root("program"),
-					"External Program Execution Failed",
-					"The resource received an unexpected error while attempting to execute the program."+
-						fmt.Sprintf("\n\nProgram: %s", cmd.Path)+
-						fmt.Sprintf("\nError Message: %s", string(exitErr.Stderr))+
-						fmt.Sprintf("\nState: %s", err),
-				)
-				return emptyMap, diag
+	// Run the program until it succeeds, fails in a way which is not retryable or runs out of attempts
+	var runs []externalRun
+	for attempt := 1; ; attempt++ {
+		run := command.run(ctx, attempt)
+		runs = append(runs, run)
+		if run.Err == nil || attempt >= policy.MaxAttempts || !policy.retryable(run, secrets) {
+			break
+		}
+		backoff := policy.backoff(attempt)
+		tflog.Warn(ctx, "External program failed, retrying", map[string]interface{}{
+			"program": run.Cmd.String(), "stage": stage, "attempt": attempt, "max_attempts": policy.MaxAttempts,
+			"error": run.Err.Error(), "backoff": backoff.String(),
+		})
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+		case <-timer.C:
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	run := runs[len(runs)-1]
+	cmd, err, resultJson, stderr := run.Cmd, run.Err, run.Stdout, run.Stderr
+	attempts := summarizeAttempts(runs, secrets)
+	// The run is kept on failure too, so a failed update can be rolled back with its output
+	emptyOutput.Run = &run
+
+	// Values returned for sensitive keys are only known once the output is parsed. The result stays empty when
+	// the output is not a JSON object.
+	result := map[string]any{}
+	parseErr := json.Unmarshal(resultJson, &result)
+	// Reserved keys are handled by the provider rather than stored in the result
+	exists, hasExists := result["__exists"]
+	requiresReplace, hasRequiresReplace := result["__requires_replace"]
+	predicted, hasPredicted := result["__predicted"]
+	warnings, hasWarnings := result["__warnings"]
+	diagnostics := result["__diagnostics"]
+	private, hasPrivate := result["__private"]
+	for _, key := range []string{"__exists", "__requires_replace", "__predicted", "__warnings", "__diagnostics", "__private"} {
+		delete(result, key)
+	}
+	convertedResult := map[string]string{}
+	for key, value := range result {
+		switch value.(type) {
+		case string:
+			convertedResult[key] = value.(string)
+		default:
+			j, err := json.Marshal(value)
+			if err != nil {
+				diag.AddError("json conversion error", fmt.Sprintf("The resource was configured with an invalid result for key: %s", key))
+				return emptyOutput, diag
 			}
-
-			diag.AddAttributeError(
-				path.Root("program"),
-				"External Program Execution Failed",
-				"The resource received an unexpected error while attempting to execute the program.\n\n"+
-					"The program was executed, however it returned no additional error messaging."+
-					fmt.Sprintf("\n\nProgram: %s", cmd.Path)+
-					fmt.Sprintf("\nState: %s", err),
-			)
-			return emptyMap, diag
+			convertedResult[key] = string(j)
+		}
+		if sensitiveKeys[key] && convertedResult[key] != "" {
+			secrets = append(secrets, convertedResult[key])
 		}
+	}
+	ctx = tflog.MaskLogStrings(ctx, secrets...)
+	emptyOutput.Secrets = secrets
+
+	if parseErr != nil && len(sensitiveKeys) > 0 {
+		tflog.Trace(ctx, "Executed external program, output not logged as it could not be parsed to hide sensitive values", map[string]interface{}{"program": cmd.String()})
+	} else {
+		tflog.Trace(ctx, "Executed external program", map[string]interface{}{"program": cmd.String(), "output": string(resultJson)})
+	}
 
+	// Diagnostics reported by the program are turned into Terraform diagnostics, whether it succeeded or not
+	reported, reportErr := programDiagnostics(diagnostics, query, sensitiveQuery, programPath, secrets)
+	if reportErr != nil {
 		diag.AddAttributeError(
-			path.Root("program"),
-			"External Program Execution Failed",
-			"The resource received an unexpected error while attempting to execute the program."+
-				fmt.Sprintf("\n\nProgram: %s", cmd.Path)+
-				fmt.Sprintf("\nError: %s", err),
+			programPath,
+			"Unexpected External Program Results",
+			fmt.Sprintf("The program returned an invalid value for the reserved key __diagnostics: %s", reportErr),
 		)
-		return emptyMap, diag
+		return emptyOutput, diag
 	}
 
-	result := map[string]any{}
-	err = json.Unmarshal(resultJson, &result)
+	// A failed run fails the stage, unless on_failure records the failure along with what the program managed to
+	// output
 	if err != nil {
+		diag.Append(runFailure(run, reported, stage, timeout, gracePeriod, programPath, secrets, attempts)...)
+		if !config.toleratesFailure(stage) {
+			return emptyOutput, diag
+		}
+	}
+
+	if parseErr != nil && err == nil {
 		diag.AddAttributeError(
-			path.Root("program"),
+			programPath,
 			"Unexpected External Program Results",
 			`The resource received unexpected results after executing the program.
 
@@ -531,39 +2297,183 @@ Program output must be a JSON encoded map of string keys and string values.
 If the error is unclear, the output can be viewed by enabling Terraform's logging at TRACE level. Terraform documentation on logging: https://www.terraform.io/internals/debugging
 `+
 				fmt.Sprintf("\nProgram: %s", cmd.Path)+
-				fmt.Sprintf("\nResult Error: %s", err),
+				fmt.Sprintf("\nResult Error: %s", parseErr),
 		)
-		return emptyMap, diag
+		return emptyOutput, diag
 	}
 
-	// Handle non-string values as stringified json
-	convertedResult := map[string]string{}
-	for key, value := range result {
+	// An error reported by a program which exited successfully still fails the stage
+	if err == nil {
+		diag.Append(reported...)
+		if diag.HasError() {
+			return emptyOutput, diag
+		}
+	}
+
+	output := externalOutput{
+		Stderr: types.StringNull(), ExitCode: types.Int64Null(), DurationMs: types.Int64Null(), LastRunAt: types.StringNull(),
+		Exists: true, ID: types.StringNull(), Private: oldPrivate, Failed: err != nil, Run: &run, Secrets: secrets,
+	}
+	if config.CaptureOutput.ValueBool() {
+		output.Stderr = types.StringValue(stderr.Text(captureMaxBytes, secrets))
+		output.ExitCode = types.Int64Value(int64(cmd.ProcessState.ExitCode()))
+		output.DurationMs = types.Int64Value(run.Duration.Milliseconds())
+		output.LastRunAt = types.StringValue(run.StartedAt.UTC().Format(time.RFC3339))
+	}
+
+	// A failed run which did not output a JSON object keeps the previous result instead of emptying it
+	if err != nil && parseErr != nil {
+		previousResult, mapDiags := types.MapValueFrom(ctx, types.StringType, oldResult)
+		diag.Append(mapDiags...)
+		previousSensitiveResult, mapDiags := types.MapValueFrom(ctx, types.StringType, oldSensitiveResult)
+		diag.Append(mapDiags...)
+		output.Result, output.SensitiveResult, output.ResultJSON = previousResult, previousSensitiveResult, config.ResultJSON
+		return output, diag
+	}
+	if hasExists {
+		value, ok := exists.(bool)
+		if !ok {
+			diag.AddAttributeError(
+				programPath,
+				"Unexpected External Program Results",
+				fmt.Sprintf("The program returned a non-boolean value for the reserved key __exists: %v", exists),
+			)
+			return emptyOutput, diag
+		}
+		output.Exists = value
+	}
+	if hasRequiresReplace {
+		value, ok := requiresReplace.(bool)
+		if !ok {
+			diag.AddAttributeError(
+				programPath,
+				"Unexpected External Program Results",
+				fmt.Sprintf("The program returned a non-boolean value for the reserved key __requires_replace: %v", requiresReplace),
+			)
+			return emptyOutput, diag
+		}
+		output.RequiresReplace = value
+	}
+	if hasPredicted {
+		value, ok := predicted.(bool)
+		if !ok {
+			diag.AddAttributeError(
+				programPath,
+				"Unexpected External Program Results",
+				fmt.Sprintf("The program returned a non-boolean value for the reserved key __predicted: %v", predicted),
+			)
+			return emptyOutput, diag
+		}
+		output.Predicted = value
+	}
+	if hasPrivate {
+		if _, ok := private.(map[string]any); !ok {
+			diag.AddAttributeError(
+				programPath,
+				"Unexpected External Program Results",
+				"The program returned a value which is not a JSON object for the reserved key __private.",
+			)
+			return emptyOutput, diag
+		}
+		// Decoded from JSON, so it can always be encoded again
+		output.Private, _ = json.Marshal(private)
+	}
+	if hasWarnings {
+		values, ok := warnings.([]any)
+		for _, value := range values {
+			warning, isString := value.(string)
+			if !isString {
+				ok = false
+				break
+			}
+			output.Warnings = append(output.Warnings, redact(warning, secrets))
+		}
+		if !ok {
+			diag.AddAttributeError(
+				programPath,
+				"Unexpected External Program Results",
+				"The program returned a value which is not a list of strings for the reserved key __warnings.",
+			)
+			return emptyOutput, diag
+		}
+	}
+
+	// The id returned on create or import becomes the resource id, later stages cannot change it
+	if id, ok := convertedResult["id"]; ok {
+		switch {
+		case stage != "create" && stage != "import":
+			if id != config.ID.ValueString() {
+				tflog.Warn(ctx, "Ignoring id returned by the external program, the id can only be set on create or import", map[string]interface{}{
+					"stage": stage, "id": config.ID.ValueString(), "returned_id": id,
+				})
+			}
+		case sensitiveKeys["id"]:
+			diag.AddAttributeError(
+				path.Root("id"),
+				"Sensitive Resource ID",
+				"The program returned the resource id under a sensitive key. The id of a resource is always "+
+					"shown in the plan output, remove \"id\" from sensitive_query and sensitive_result_keys.",
+			)
+			return emptyOutput, diag
+		case id == "":
+			diag.AddAttributeError(
+				path.Root("id"),
+				"Invalid Resource ID",
+				"The program returned an empty value for the reserved key id.",
+			)
+			return emptyOutput, diag
+		default:
+			output.ID = types.StringValue(id)
+		}
+	}
+
+	// Split the sensitive keys out of the result, non-string values are handled as stringified json
+	plainResult := map[string]string{}
+	sensitiveResult := map[string]string{}
+	for key, value := range convertedResult {
 		if key == "old_result" {
 			diag.AddAttributeError(path.Root("result"),
 				"Reserved Result Key",
-				fmt.Sprintf("The resource was configured with a reserved result key that can cause nested duplicates: %s\nresult: %s\n", key, result),
+				fmt.Sprintf("The resource was configured with a reserved result key that can cause nested duplicates: %s\nresult: %s\n", key, redact(fmt.Sprint(result), secrets)),
 			)
-			return emptyMap, diag
+			return emptyOutput, diag
 		}
-		switch value.(type) {
-		case string:
-			convertedResult[key] = value.(string)
-		default:
-			j, err := json.Marshal(value)
-			if err != nil {
-				diag.AddError("json conversion error", fmt.Sprintf("The resource was configured with an invalid result: %v\nerror value: %v", result, value))
-				return emptyMap, diag
-			}
-			convertedResult[key] = string(j)
+		if sensitiveKeys[key] {
+			sensitiveResult[key] = value
+			continue
 		}
+		plainResult[key] = value
 	}
 
-	from_result, from_diag := types.MapValueFrom(ctx, types.StringType, convertedResult)
-	if err != nil {
+	// The raw values keep the exact JSON of the output, such as large numbers which do not fit a float64
+	rawResult := map[string]json.RawMessage{}
+	if err := json.Unmarshal(resultJson, &rawResult); err != nil && parseErr == nil {
+		diag.AddError("json conversion error", fmt.Sprintf("The program output could not be converted to the typed result: %s", err))
+		return emptyOutput, diag
+	}
+	typedResult := map[string]json.RawMessage{}
+	for key := range plainResult {
+		typedResult[key] = rawResult[key]
+	}
+	typedResultJSON, marshalErr := json.Marshal(typedResult)
+	if marshalErr != nil {
+		diag.AddError("json conversion error", fmt.Sprintf("The program output could not be converted to the typed result: %s", marshalErr))
+		return emptyOutput, diag
+	}
+
+	from_result, from_diag := types.MapValueFrom(ctx, types.StringType, plainResult)
+	if from_diag.HasError() {
+		diag.Append(from_diag...)
+		return emptyOutput, diag
+	}
+	from_sensitive_result, from_diag := types.MapValueFrom(ctx, types.StringType, sensitiveResult)
+	if from_diag.HasError() {
 		diag.Append(from_diag...)
-		return emptyMap, diag
+		return emptyOutput, diag
 	}
 
-	return from_result, nil
+	output.Result = from_result
+	output.SensitiveResult = from_sensitive_result
+	output.ResultJSON = types.StringValue(string(typedResultJSON))
+	return output, diag
 }
@@ -1,6 +1,8 @@
 package provider
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"os"
 	"os/exec"
@@ -9,6 +11,9 @@ import (
 	"regexp"
 	"testing"
 
+	fwresource "github.com/hashicorp/terraform-plugin-framework/resource"
+	"github.com/hashicorp/terraform-plugin-framework/tfsdk"
+	"github.com/hashicorp/terraform-plugin-go/tftypes"
 	"github.com/hashicorp/terraform-plugin-testing/helper/resource"
 	"github.com/hashicorp/terraform-plugin-testing/plancheck"
 	"github.com/hashicorp/terraform-plugin-testing/terraform"
@@ -191,6 +196,1944 @@ func TestResource_Program_EmptyStringAndNullValues(t *testing.T) {
 	})
 }
 
+func TestResource_StagePrograms(t *testing.T) {
+	programPath, err := buildGoTestProgram()
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+
+	resource.UnitTest(t, resource.TestCase{
+		ProtoV6ProviderFactories: protoV6ProviderFactories(),
+		Steps: []resource.TestStep{
+			{
+				Config: fmt.Sprintf(`
+					resource "toolbox_external" "test" {
+						update = true
+						delete = true
+						program        = [%[1]q, "default"]
+						create_program = [%[1]q, "provision"]
+						delete_program = [%[1]q, "teardown"]
+
+						query = {
+							value = "one"
+						}
+					}
+				`, programPath),
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttr("toolbox_external.test", "stage", "create"),
+					resource.TestCheckResourceAttr("toolbox_external.test", "result.argument", "provision"),
+				),
+			},
+			{
+				Config: fmt.Sprintf(`
+					resource "toolbox_external" "test" {
+						update = true
+						delete = true
+						program        = [%[1]q, "default"]
+						create_program = [%[1]q, "provision"]
+						delete_program = [%[1]q, "teardown"]
+
+						query = {
+							value = "two"
+						}
+					}
+				`, programPath),
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttr("toolbox_external.test", "stage", "update"),
+					resource.TestCheckResourceAttr("toolbox_external.test", "result.argument", "default"),
+				),
+			},
+		},
+	})
+}
+
+func TestResource_StagePrograms_Missing(t *testing.T) {
+	programPath, err := buildGoTestProgram()
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+
+	resource.UnitTest(t, resource.TestCase{
+		ProtoV6ProviderFactories: protoV6ProviderFactories(),
+		Steps: []resource.TestStep{
+			{
+				Config: fmt.Sprintf(`
+					resource "toolbox_external" "test" {
+						delete = true
+						create_program = [%[1]q]
+					}
+				`, programPath),
+				PlanOnly:    true,
+				ExpectError: regexp.MustCompile(`(?s)External Program Missing.*enabled stage\(s\): delete`),
+			},
+		},
+	})
+}
+
+func TestResource_Environment(t *testing.T) {
+	programPath, err := buildGoTestProgram()
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+
+	t.Setenv("TOOLBOX_TEST_INHERITED", "inherited")
+
+	resource.UnitTest(t, resource.TestCase{
+		ProtoV6ProviderFactories: protoV6ProviderFactories(),
+		Steps: []resource.TestStep{
+			{
+				Config: fmt.Sprintf(`
+					resource "toolbox_external" "all" {
+						program = [%[1]q]
+
+						query = {
+							env = "TOOLBOX_TEST_INHERITED"
+						}
+					}
+
+					resource "toolbox_external" "none" {
+						program             = [%[1]q]
+						inherit_environment = "none"
+
+						query = {
+							env = "TOOLBOX_TEST_INHERITED"
+						}
+					}
+
+					resource "toolbox_external" "allowlist" {
+						program                   = [%[1]q]
+						inherit_environment       = "allowlist"
+						inherit_environment_names = ["TOOLBOX_TEST_INHERITED"]
+
+						query = {
+							env = "TOOLBOX_TEST_INHERITED"
+						}
+					}
+
+					resource "toolbox_external" "configured" {
+						program             = [%[1]q]
+						inherit_environment = "none"
+
+						environment = {
+							TOOLBOX_TEST_CONFIGURED = "plain"
+						}
+						sensitive_environment = {
+							TOOLBOX_TEST_CONFIGURED = "secret"
+						}
+
+						query = {
+							env = "TOOLBOX_TEST_CONFIGURED"
+						}
+					}
+				`, programPath),
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttr("toolbox_external.all", "result.env_value", "inherited"),
+					resource.TestCheckResourceAttr("toolbox_external.none", "result.env_value", ""),
+					resource.TestCheckResourceAttr("toolbox_external.allowlist", "result.env_value", "inherited"),
+					resource.TestCheckResourceAttr("toolbox_external.configured", "result.env_value", "secret"),
+				),
+			},
+		},
+	})
+}
+
+func TestResource_Environment_MissingAllowlist(t *testing.T) {
+	resource.UnitTest(t, resource.TestCase{
+		ProtoV6ProviderFactories: protoV6ProviderFactories(),
+		Steps: []resource.TestStep{
+			{
+				Config: `
+					resource "toolbox_external" "test" {
+						program             = ["true"]
+						inherit_environment = "allowlist"
+					}
+				`,
+				PlanOnly:    true,
+				ExpectError: regexp.MustCompile(`Missing Environment Allowlist`),
+			},
+		},
+	})
+}
+
+func TestResource_Sensitive(t *testing.T) {
+	programPath, err := buildGoTestProgram()
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+
+	resource.UnitTest(t, resource.TestCase{
+		ProtoV6ProviderFactories: protoV6ProviderFactories(),
+		Steps: []resource.TestStep{
+			{
+				Config: fmt.Sprintf(`
+					resource "toolbox_external" "test" {
+						program               = [%[1]q]
+						sensitive_result_keys = ["result"]
+
+						query = {
+							value = "plain"
+						}
+						sensitive_query = {
+							password = "hunter2"
+						}
+					}
+				`, programPath),
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttr("toolbox_external.test", "result.value", "plain"),
+					resource.TestCheckNoResourceAttr("toolbox_external.test", "result.password"),
+					resource.TestCheckNoResourceAttr("toolbox_external.test", "result.result"),
+					resource.TestCheckResourceAttr("toolbox_external.test", "sensitive_result.password", "hunter2"),
+					resource.TestCheckResourceAttr("toolbox_external.test", "sensitive_result.result", "yes"),
+				),
+			},
+		},
+	})
+}
+
+func TestResource_Sensitive_DuplicateKey(t *testing.T) {
+	programPath, err := buildGoTestProgram()
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+
+	resource.UnitTest(t, resource.TestCase{
+		ProtoV6ProviderFactories: protoV6ProviderFactories(),
+		Steps: []resource.TestStep{
+			{
+				Config: fmt.Sprintf(`
+					resource "toolbox_external" "test" {
+						program = [%[1]q]
+
+						query = {
+							password = "plain"
+						}
+						sensitive_query = {
+							password = "hunter2"
+						}
+					}
+				`, programPath),
+				ExpectError: regexp.MustCompile(`Duplicate Query Key`),
+			},
+		},
+	})
+}
+
+func TestResource_ResultJSON(t *testing.T) {
+	programPath, err := buildGoTestProgram()
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+
+	resource.UnitTest(t, resource.TestCase{
+		ProtoV6ProviderFactories: protoV6ProviderFactories(),
+		Steps: []resource.TestStep{
+			{
+				Config: fmt.Sprintf(`
+					resource "toolbox_external" "test" {
+						program = [%[1]q]
+
+						query = {
+							value   = "one"
+							count   = "3"
+							enabled = "true"
+							list    = jsonencode(["a", { nested = 1 }])
+						}
+						sensitive_query = {
+							secret = "hidden"
+						}
+					}
+
+					output "count" {
+						value = jsondecode(toolbox_external.test.result_json).count + 1
+					}
+				`, programPath),
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttr("toolbox_external.test", "result.count", "3"),
+					resource.TestCheckResourceAttr("toolbox_external.test", "result_json",
+						`{"count":3,"enabled":true,"list":["a",{"nested":1}],"query_value":"one","result":"yes","stage":"create","value":"one"}`),
+					resource.TestCheckOutput("count", "4"),
+				),
+			},
+		},
+	})
+}
+
+func TestResource_Input(t *testing.T) {
+	programPath, err := buildGoTestProgram()
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+
+	resource.UnitTest(t, resource.TestCase{
+		ProtoV6ProviderFactories: protoV6ProviderFactories(),
+		Steps: []resource.TestStep{
+			{
+				Config: fmt.Sprintf(`
+					resource "toolbox_external" "test" {
+						program = [%[1]q]
+
+						input = jsonencode({
+							name  = "host"
+							disks = [{ size = 10 }, { size = 20 }]
+						})
+					}
+				`, programPath),
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttr("toolbox_external.test", "result.input", `{"disks":[{"size":10},{"size":20}],"name":"host"}`),
+					resource.TestCheckResourceAttr("toolbox_external.test", "result_json",
+						`{"input":{"disks":[{"size":10},{"size":20}],"name":"host"},"query_value":null,"result":"yes","stage":"create"}`),
+				),
+			},
+		},
+	})
+}
+
+func TestResource_Input_Invalid(t *testing.T) {
+	programPath, err := buildGoTestProgram()
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+
+	resource.UnitTest(t, resource.TestCase{
+		ProtoV6ProviderFactories: protoV6ProviderFactories(),
+		Steps: []resource.TestStep{
+			{
+				Config: fmt.Sprintf(`
+					resource "toolbox_external" "test" {
+						program = [%[1]q]
+						input   = "{not json"
+					}
+				`, programPath),
+				ExpectError: regexp.MustCompile(`Invalid JSON`),
+			},
+		},
+	})
+}
+
+func TestResource_QueryEncoding(t *testing.T) {
+	programPath, err := buildGoTestProgram()
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+
+	config := func(encoding string) string {
+		return fmt.Sprintf(`
+			resource "toolbox_external" "test" {
+				program        = [%[1]q]
+				query_encoding = %[2]q
+
+				query = {
+					value = "123"
+				}
+			}
+		`, programPath, encoding)
+	}
+
+	resource.UnitTest(t, resource.TestCase{
+		ProtoV6ProviderFactories: protoV6ProviderFactories(),
+		Steps: []resource.TestStep{
+			{
+				Config: config("auto"),
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestMatchResourceAttr("toolbox_external.test", "result_json", regexp.MustCompile(`"value":123[,}]`)),
+				),
+			},
+			{
+				Config: config("raw"),
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestMatchResourceAttr("toolbox_external.test", "result_json", regexp.MustCompile(`"value":"123"`)),
+				),
+			},
+			{
+				Config: config("json"),
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestMatchResourceAttr("toolbox_external.test", "result_json", regexp.MustCompile(`"value":123[,}]`)),
+				),
+			},
+		},
+	})
+}
+
+func TestResource_QueryEncoding_InvalidJSON(t *testing.T) {
+	programPath, err := buildGoTestProgram()
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+
+	resource.UnitTest(t, resource.TestCase{
+		ProtoV6ProviderFactories: protoV6ProviderFactories(),
+		Steps: []resource.TestStep{
+			{
+				Config: fmt.Sprintf(`
+					resource "toolbox_external" "test" {
+						program        = [%[1]q]
+						query_encoding = "json"
+
+						query = {
+							value = "pizza"
+						}
+					}
+				`, programPath),
+				ExpectError: regexp.MustCompile(`Invalid Query Value`),
+			},
+		},
+	})
+}
+
+func TestResource_CaptureOutput(t *testing.T) {
+	programPath, err := buildGoTestProgram()
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+
+	resource.UnitTest(t, resource.TestCase{
+		ProtoV6ProviderFactories: protoV6ProviderFactories(),
+		Steps: []resource.TestStep{
+			{
+				Config: fmt.Sprintf(`
+					resource "toolbox_external" "test" {
+						program = [%[1]q]
+
+						query = {
+							stderr = "[WARNING]: something to look at"
+						}
+					}
+				`, programPath),
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckNoResourceAttr("toolbox_external.test", "stderr"),
+					resource.TestCheckNoResourceAttr("toolbox_external.test", "exit_code"),
+					resource.TestCheckNoResourceAttr("toolbox_external.test", "last_run_at"),
+				),
+			},
+			{
+				Config: fmt.Sprintf(`
+					resource "toolbox_external" "test" {
+						program           = [%[1]q]
+						update            = true
+						capture_output    = true
+						capture_max_bytes = 21
+
+						query = {
+							stderr = "[WARNING]: something to look at"
+						}
+					}
+				`, programPath),
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttr("toolbox_external.test", "stderr", "something to look at\n"),
+					resource.TestCheckResourceAttr("toolbox_external.test", "exit_code", "0"),
+					resource.TestCheckResourceAttrSet("toolbox_external.test", "duration_ms"),
+					resource.TestMatchResourceAttr("toolbox_external.test", "last_run_at", regexp.MustCompile(`^\d{4}-\d{2}-\d{2}T`)),
+				),
+			},
+		},
+	})
+}
+
+func TestResource_LogStdout(t *testing.T) {
+	programPath, err := buildGoTestProgram()
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+
+	resource.UnitTest(t, resource.TestCase{
+		ProtoV6ProviderFactories: protoV6ProviderFactories(),
+		Steps: []resource.TestStep{
+			{
+				Config: fmt.Sprintf(`
+					resource "toolbox_external" "test" {
+						program    = [%[1]q]
+						log_stdout = true
+
+						query = {
+							value  = "pizza"
+							stderr = "progress"
+						}
+					}
+				`, programPath),
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttr("toolbox_external.test", "result.query_value", "pizza"),
+				),
+			},
+		},
+	})
+}
+
+func TestResource_LogStdout_Sensitive(t *testing.T) {
+	programPath, err := buildGoTestProgram()
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+
+	config := func(sensitive string) string {
+		return fmt.Sprintf(`
+			resource "toolbox_external" "test" {
+				program    = [%[1]q]
+				log_stdout = true
+
+				%[2]s
+			}
+		`, programPath, sensitive)
+	}
+
+	resource.UnitTest(t, resource.TestCase{
+		ProtoV6ProviderFactories: protoV6ProviderFactories(),
+		Steps: []resource.TestStep{
+			{
+				Config:      config(`sensitive_result_keys = ["password"]`),
+				PlanOnly:    true,
+				ExpectError: regexp.MustCompile(`Sensitive Output Logged`),
+			},
+			{
+				Config: config(`sensitive_query = {
+					password = "secret"
+				}`),
+				PlanOnly:    true,
+				ExpectError: regexp.MustCompile(`Sensitive Output Logged`),
+			},
+		},
+	})
+}
+
+func TestResource_Retry(t *testing.T) {
+	programPath, err := buildGoTestProgram()
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+
+	resource.UnitTest(t, resource.TestCase{
+		ProtoV6ProviderFactories: protoV6ProviderFactories(),
+		Steps: []resource.TestStep{
+			{
+				Config: fmt.Sprintf(`
+					resource "toolbox_external" "test" {
+						program = [%[1]q]
+
+						query = {
+							attempts_file = %[2]q
+							fail_attempts = "2"
+						}
+
+						retry {
+							max_attempts              = 3
+							initial_backoff           = "10ms"
+							retryable_stderr_patterns = ["transient failure"]
+						}
+					}
+				`, programPath, filepath.Join(t.TempDir(), "attempts")),
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttr("toolbox_external.test", "result.attempt", "3"),
+				),
+			},
+		},
+	})
+}
+
+func TestResource_Retry_Exhausted(t *testing.T) {
+	programPath, err := buildGoTestProgram()
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+
+	resource.UnitTest(t, resource.TestCase{
+		ProtoV6ProviderFactories: protoV6ProviderFactories(),
+		Steps: []resource.TestStep{
+			{
+				Config: fmt.Sprintf(`
+					resource "toolbox_external" "test" {
+						program = [%[1]q]
+
+						query = {
+							attempts_file = %[2]q
+							fail_attempts = "5"
+						}
+
+						retry {
+							max_attempts         = 2
+							initial_backoff      = "10ms"
+							retryable_exit_codes = [1]
+						}
+					}
+				`, programPath, filepath.Join(t.TempDir(), "attempts")),
+				ExpectError: regexp.MustCompile(`The program was run 2 times`),
+			},
+		},
+	})
+}
+
+func TestResource_Diagnostics(t *testing.T) {
+	programPath, err := buildGoTestProgram()
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+
+	config := func(severity string) string {
+		return fmt.Sprintf(`
+			resource "toolbox_external" "test" {
+				update  = true
+				program = [%[1]q]
+
+				query = {
+					disk_size = "5"
+					diagnostics = jsonencode([{
+						severity  = %[2]q
+						summary   = "Disk Too Small"
+						detail    = "The disk should be at least 10 GB."
+						query_key = "disk_size"
+					}])
+				}
+			}
+		`, programPath, severity)
+	}
+
+	resource.UnitTest(t, resource.TestCase{
+		ProtoV6ProviderFactories: protoV6ProviderFactories(),
+		Steps: []resource.TestStep{
+			{
+				Config: config("warning"),
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttr("toolbox_external.test", "result.disk_size", "5"),
+					resource.TestCheckNoResourceAttr("toolbox_external.test", "result.__diagnostics"),
+				),
+			},
+			{
+				Config:      config("error"),
+				ExpectError: regexp.MustCompile(`Disk Too Small`),
+			},
+		},
+	})
+}
+
+func TestResource_Private(t *testing.T) {
+	programPath, err := buildGoTestProgram()
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+
+	config := func(value string) string {
+		return fmt.Sprintf(`
+			resource "toolbox_external" "test" {
+				update  = true
+				program = [%[1]q]
+
+				query = {
+					private = %[2]q
+				}
+			}
+		`, programPath, value)
+	}
+
+	resource.UnitTest(t, resource.TestCase{
+		ProtoV6ProviderFactories: protoV6ProviderFactories(),
+		Steps: []resource.TestStep{
+			{
+				Config: config("one"),
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckNoResourceAttr("toolbox_external.test", "result.old_private_value"),
+					resource.TestCheckNoResourceAttr("toolbox_external.test", "result.__private"),
+				),
+			},
+			{
+				Config: config("two"),
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttr("toolbox_external.test", "result.old_private_value", "one"),
+					resource.TestCheckNoResourceAttr("toolbox_external.test", "result.__private"),
+				),
+			},
+		},
+	})
+}
+
+func TestResource_OldQuery(t *testing.T) {
+	programPath, err := buildGoTestProgram()
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+
+	workingDir := t.TempDir()
+	config := func(query string) string {
+		return fmt.Sprintf(`
+			resource "toolbox_external" "test" {
+				update      = true
+				program     = [%[1]q]
+				working_dir = %[2]q
+
+				query = {
+					%[3]s
+				}
+			}
+		`, programPath, workingDir, query)
+	}
+
+	resource.UnitTest(t, resource.TestCase{
+		ProtoV6ProviderFactories: protoV6ProviderFactories(),
+		Steps: []resource.TestStep{
+			{
+				Config: config(`value = "one", other = "same"`),
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttr("toolbox_external.test", "stage", "create"),
+					resource.TestCheckNoResourceAttr("toolbox_external.test", "result.old_query"),
+					resource.TestCheckNoResourceAttr("toolbox_external.test", "result.changed_keys"),
+				),
+			},
+			{
+				Config: config(`value = "two", other = "same", added = "yes"`),
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttr("toolbox_external.test", "stage", "update"),
+					resource.TestCheckResourceAttr("toolbox_external.test", "result.old_query", `{"other":"same","value":"one"}`),
+					resource.TestCheckResourceAttr("toolbox_external.test", "result.old_working_dir", workingDir),
+					resource.TestCheckResourceAttr("toolbox_external.test", "result.changed_keys", `["added","value"]`),
+				),
+			},
+		},
+	})
+}
+
+func TestResource_ProviderDefaults(t *testing.T) {
+	programPath, err := buildGoTestProgram()
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+
+	workingDir := t.TempDir()
+	config := func(value string) string {
+		return fmt.Sprintf(`
+			provider "toolbox" {
+				working_dir = %[2]q
+				update      = true
+
+				environment = {
+					TOOLBOX_PROVIDER_VARIABLE = "provider"
+				}
+				query = {
+					print_working_dir = "true"
+					value             = "provider"
+					shared            = "provider"
+				}
+			}
+
+			resource "toolbox_external" "test" {
+				program = [%[1]q]
+
+				query = {
+					env   = "TOOLBOX_PROVIDER_VARIABLE"
+					value = %[3]q
+				}
+			}
+		`, programPath, workingDir, value)
+	}
+
+	resource.UnitTest(t, resource.TestCase{
+		ProtoV6ProviderFactories: protoV6ProviderFactories(),
+		Steps: []resource.TestStep{
+			{
+				Config: config("one"),
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttr("toolbox_external.test", "stage", "create"),
+					resource.TestCheckResourceAttr("toolbox_external.test", "update", "true"),
+					resource.TestCheckResourceAttr("toolbox_external.test", "result.working_dir", workingDir),
+					resource.TestCheckResourceAttr("toolbox_external.test", "result.env_value", "provider"),
+					resource.TestCheckResourceAttr("toolbox_external.test", "result.query_value", "one"),
+					resource.TestCheckResourceAttr("toolbox_external.test", "result.shared", "provider"),
+					resource.TestCheckNoResourceAttr("toolbox_external.test", "working_dir"),
+					resource.TestCheckResourceAttr("toolbox_external.test", "query.%", "2"),
+				),
+			},
+			{
+				// The update stage is enabled by the provider
+				Config: config("two"),
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttr("toolbox_external.test", "stage", "update"),
+					resource.TestCheckResourceAttr("toolbox_external.test", "result.query_value", "two"),
+				),
+			},
+		},
+	})
+}
+
+func TestResource_ProviderDefaults_Invalid(t *testing.T) {
+	programPath, err := buildGoTestProgram()
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+
+	config := func(providerBlock string, resourceBlock string) string {
+		return fmt.Sprintf(`
+			provider "toolbox" {
+				%[1]s
+			}
+
+			resource "toolbox_external" "test" {
+				%[2]s
+			}
+		`, providerBlock, resourceBlock)
+	}
+
+	resource.UnitTest(t, resource.TestCase{
+		ProtoV6ProviderFactories: protoV6ProviderFactories(),
+		Steps: []resource.TestStep{
+			{
+				Config: config(`query = {
+					stage = "create"
+				}`, fmt.Sprintf(`program = [%q]`, programPath)),
+				PlanOnly:    true,
+				ExpectError: regexp.MustCompile(`Reserved Query Key`),
+			},
+			{
+				// The read stage enabled by the provider has no program, only the create stage has one
+				Config:      config(`read = true`, fmt.Sprintf(`create_program = [%q]`, programPath)),
+				PlanOnly:    true,
+				ExpectError: regexp.MustCompile(`External Program Missing`),
+			},
+			{
+				Config: config(`query = {
+					value = "pizza"
+				}`, fmt.Sprintf(`program = [%q]
+				query_encoding = "json"`, programPath)),
+				PlanOnly:    true,
+				ExpectError: regexp.MustCompile(`Invalid Query Value`),
+			},
+		},
+	})
+}
+
+func TestResource_ProgramPolicy(t *testing.T) {
+	programPath, err := buildGoTestProgram()
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+
+	config := func(policy string, program string) string {
+		return fmt.Sprintf(`
+			provider "toolbox" {
+				%[1]s
+			}
+
+			resource "toolbox_external" "test" {
+				program = %[2]s
+			}
+		`, policy, program)
+	}
+
+	resource.UnitTest(t, resource.TestCase{
+		ProtoV6ProviderFactories: protoV6ProviderFactories(),
+		Steps: []resource.TestStep{
+			{
+				Config:      config(fmt.Sprintf(`denied_programs = [%q]`, programPath), fmt.Sprintf(`[%q]`, programPath)),
+				PlanOnly:    true,
+				ExpectError: regexp.MustCompile(`External Program Denied`),
+			},
+			{
+				Config:      config(`allowed_programs = ["regexp:/nowhere/.*"]`, fmt.Sprintf(`[%q]`, programPath)),
+				PlanOnly:    true,
+				ExpectError: regexp.MustCompile(`External Program Not Allowed`),
+			},
+			{
+				Config:      config(`allowed_arguments = "[a-z]+"`, fmt.Sprintf(`[%q, "argument", "NOT-ALLOWED"]`, programPath)),
+				PlanOnly:    true,
+				ExpectError: regexp.MustCompile(`External Program Argument Not Allowed`),
+			},
+			{
+				Config: config(fmt.Sprintf(`allowed_programs = [%q]
+				allowed_arguments = "[a-z]+"`, filepath.Join(filepath.Dir(programPath), "*")), fmt.Sprintf(`[%q, "argument"]`, programPath)),
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttr("toolbox_external.test", "result.argument", "argument"),
+				),
+			},
+		},
+	})
+}
+
+func TestResource_ProgramPolicy_WorkingDir(t *testing.T) {
+	programPath, err := buildGoTestProgram()
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+
+	// Both working directories hold the program at the same relative path, only the trusted one is allowed
+	trustedDir, otherDir := t.TempDir(), t.TempDir()
+	for _, dir := range []string{trustedDir, otherDir} {
+		if err := os.Mkdir(filepath.Join(dir, "scripts"), 0o700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(programPath, filepath.Join(dir, "scripts", "program")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	config := func(workingDir string) string {
+		return fmt.Sprintf(`
+			provider "toolbox" {
+				working_dir      = %[1]q
+				allowed_programs = [%[2]q]
+			}
+
+			resource "toolbox_external" "test" {
+				program     = ["scripts/program"]
+				working_dir = %[3]s
+
+				query = {
+					print_working_dir = "true"
+				}
+			}
+		`, trustedDir, filepath.Join(trustedDir, "scripts", "*"), workingDir)
+	}
+
+	resource.UnitTest(t, resource.TestCase{
+		ProtoV6ProviderFactories: protoV6ProviderFactories(),
+		Steps: []resource.TestStep{
+			{
+				Config:      config(fmt.Sprintf("%q", otherDir)),
+				PlanOnly:    true,
+				ExpectError: regexp.MustCompile(`External Program Not Allowed`),
+			},
+			{
+				Config: config("null"),
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttr("toolbox_external.test", "result.working_dir", trustedDir),
+				),
+			},
+		},
+	})
+}
+
+func TestResource_ProgramPolicy_Environment(t *testing.T) {
+	programPath, err := buildGoTestProgram()
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+
+	// bash runs the script of BASH_ENV before its command, which would let the resource run anything through it
+	dir := t.TempDir()
+	marker := filepath.Join(dir, "hijacked")
+	script := filepath.Join(dir, "hijack.sh")
+	if err := os.WriteFile(script, []byte(fmt.Sprintf("touch %q\n", marker)), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	config := func(environment string) string {
+		return fmt.Sprintf(`
+			provider "toolbox" {
+				allowed_programs = ["regexp:.*/bash", %[1]q]
+				environment = {
+					GREETING = "from the provider"
+				}
+			}
+
+			resource "toolbox_external" "test" {
+				program = ["bash", "-c", "echo '{}'"]
+				%[2]s
+			}
+		`, programPath, environment)
+	}
+
+	resource.UnitTest(t, resource.TestCase{
+		ProtoV6ProviderFactories: protoV6ProviderFactories(),
+		Steps: []resource.TestStep{
+			{
+				Config:      config(fmt.Sprintf(`environment = { BASH_ENV = %q }`, script)),
+				PlanOnly:    true,
+				ExpectError: regexp.MustCompile(`External Program Environment Not Allowed`),
+			},
+			{
+				Config:      config(fmt.Sprintf(`sensitive_environment = { BASH_ENV = %q }`, script)),
+				PlanOnly:    true,
+				ExpectError: regexp.MustCompile(`External Program Environment Not Allowed`),
+			},
+			{
+				Config:      config(`environment = { ld_preload = "/tmp/hijack.so" }`),
+				PlanOnly:    true,
+				ExpectError: regexp.MustCompile(`External Program Environment Not Allowed`),
+			},
+			{
+				Config:      config(fmt.Sprintf(`environment = { PATH = %q }`, dir)),
+				PlanOnly:    true,
+				ExpectError: regexp.MustCompile(`External Program Environment Not Allowed`),
+			},
+			{
+				PreConfig: func() {
+					if _, err := os.Stat(marker); err == nil {
+						t.Fatal("the allowed program ran the script of BASH_ENV")
+					}
+				},
+				// Other variables, and the ones of the provider configuration, are not restricted
+				Config: fmt.Sprintf(`
+					provider "toolbox" {
+						allowed_programs = [%[1]q]
+						environment = {
+							PATH = %[2]q
+						}
+					}
+
+					resource "toolbox_external" "test" {
+						program = [%[1]q]
+						environment = {
+							GREETING = "hello"
+						}
+
+						query = {
+							env = "GREETING"
+						}
+					}
+				`, programPath, os.Getenv("PATH")),
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttr("toolbox_external.test", "result.env_value", "hello"),
+				),
+			},
+		},
+	})
+}
+
+func TestResource_ProgramPolicy_InvalidPattern(t *testing.T) {
+	resource.UnitTest(t, resource.TestCase{
+		ProtoV6ProviderFactories: protoV6ProviderFactories(),
+		Steps: []resource.TestStep{
+			{
+				Config: `
+					provider "toolbox" {
+						allowed_programs = ["regexp:("]
+					}
+
+					resource "toolbox_external" "test" {
+						program = ["bash"]
+					}
+				`,
+				PlanOnly:    true,
+				ExpectError: regexp.MustCompile(`Invalid Program Pattern`),
+			},
+		},
+	})
+}
+
+func TestResource_LockName(t *testing.T) {
+	programPath, err := buildGoTestProgram()
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+
+	resource.UnitTest(t, resource.TestCase{
+		ProtoV6ProviderFactories: protoV6ProviderFactories(),
+		Steps: []resource.TestStep{
+			{
+				// Terraform creates the resources in parallel, the lock runs their programs one at a time
+				Config: fmt.Sprintf(`
+					resource "toolbox_external" "test" {
+						count     = 3
+						program   = [%[1]q]
+						lock_name = "hosts"
+
+						query = {
+							running_dir = %[2]q
+						}
+					}
+				`, programPath, t.TempDir()),
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttr("toolbox_external.test.0", "result.running", "1"),
+					resource.TestCheckResourceAttr("toolbox_external.test.1", "result.running", "1"),
+					resource.TestCheckResourceAttr("toolbox_external.test.2", "result.running", "1"),
+				),
+			},
+		},
+	})
+}
+
+func TestResource_MaxConcurrentPrograms(t *testing.T) {
+	programPath, err := buildGoTestProgram()
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+
+	resource.UnitTest(t, resource.TestCase{
+		ProtoV6ProviderFactories: protoV6ProviderFactories(),
+		Steps: []resource.TestStep{
+			{
+				Config: fmt.Sprintf(`
+					provider "toolbox" {
+						max_concurrent_programs = 1
+					}
+
+					resource "toolbox_external" "test" {
+						count   = 3
+						program = [%[1]q]
+
+						query = {
+							running_dir = %[2]q
+						}
+					}
+				`, programPath, t.TempDir()),
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttr("toolbox_external.test.0", "result.running", "1"),
+					resource.TestCheckResourceAttr("toolbox_external.test.1", "result.running", "1"),
+					resource.TestCheckResourceAttr("toolbox_external.test.2", "result.running", "1"),
+				),
+			},
+		},
+	})
+}
+
+func TestResource_LockFile(t *testing.T) {
+	programPath, err := buildGoTestProgram()
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+
+	lockPath := filepath.Join(t.TempDir(), "hosts.lock")
+	config := fmt.Sprintf(`
+		resource "toolbox_external" "test" {
+			program      = [%[1]q]
+			lock_file    = %[2]q
+			lock_timeout = "1s"
+
+			query = {
+				value = "locked"
+			}
+		}
+	`, programPath, lockPath)
+
+	// The lock is held by the test, standing in for another Terraform run
+	var lock *fileLock
+	resource.UnitTest(t, resource.TestCase{
+		ProtoV6ProviderFactories: protoV6ProviderFactories(),
+		Steps: []resource.TestStep{
+			{
+				PreConfig: func() {
+					lock, err = acquireFileLock(context.Background(), lockPath, 0)
+					if err != nil {
+						t.Fatal(err)
+					}
+				},
+				Config:      config,
+				ExpectError: regexp.MustCompile(fmt.Sprintf(`(?s)External Program Lock Timed Out.*PID\s+%d`, os.Getpid())),
+			},
+			{
+				PreConfig: func() {
+					if err := lock.release(); err != nil {
+						t.Fatal(err)
+					}
+				},
+				Config: config,
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttr("toolbox_external.test", "result.query_value", "locked"),
+				),
+			},
+		},
+	})
+}
+
+func TestResource_ID(t *testing.T) {
+	programPath, err := buildGoTestProgram()
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+
+	resource.UnitTest(t, resource.TestCase{
+		ProtoV6ProviderFactories: protoV6ProviderFactories(),
+		Steps: []resource.TestStep{
+			{
+				Config: fmt.Sprintf(`
+					resource "toolbox_external" "test" {
+						update  = true
+						program = [%[1]q]
+
+						query = {
+							new_id = "host-1"
+							value  = "one"
+						}
+					}
+				`, programPath),
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttr("toolbox_external.test", "id", "host-1"),
+					resource.TestCheckResourceAttr("toolbox_external.test", "result.id", "host-1"),
+				),
+			},
+			{
+				Config: fmt.Sprintf(`
+					resource "toolbox_external" "test" {
+						update  = true
+						program = [%[1]q]
+
+						query = {
+							new_id = "host-2"
+							value  = "two"
+						}
+					}
+				`, programPath),
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttr("toolbox_external.test", "stage", "update"),
+					resource.TestCheckResourceAttr("toolbox_external.test", "id", "host-1"),
+					// The id is passed to the update stage and echoed back by the test program
+					resource.TestCheckResourceAttr("toolbox_external.test", "result.id", "host-1"),
+					resource.TestCheckResourceAttr("toolbox_external.test", "result.value", "two"),
+				),
+			},
+		},
+	})
+}
+
+func TestResource_ReservedQueryKey(t *testing.T) {
+	programPath, err := buildGoTestProgram()
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+
+	resource.UnitTest(t, resource.TestCase{
+		ProtoV6ProviderFactories: protoV6ProviderFactories(),
+		Steps: []resource.TestStep{
+			{
+				// Reserved keys fail the plan, before any program runs
+				Config: fmt.Sprintf(`
+					resource "toolbox_external" "test" {
+						read    = true
+						program = [%[1]q]
+
+						sensitive_query = {
+							__toolbox = "{}"
+						}
+					}
+				`, programPath),
+				PlanOnly:    true,
+				ExpectError: regexp.MustCompile(`Reserved Query Key`),
+			},
+			{
+				// The id of the resource is passed under __toolbox, so id remains a query key like any other
+				Config: fmt.Sprintf(`
+					resource "toolbox_external" "test" {
+						read    = true
+						program = [%[1]q]
+
+						query = {
+							id = "host-1"
+						}
+					}
+				`, programPath),
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttr("toolbox_external.test", "id", "host-1"),
+					resource.TestCheckResourceAttr("toolbox_external.test", "query.id", "host-1"),
+				),
+			},
+		},
+	})
+}
+
+func TestResource_Read_NotExists(t *testing.T) {
+	programPath, err := buildGoTestProgram()
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+
+	marker := filepath.Join(t.TempDir(), "marker")
+	config := fmt.Sprintf(`
+		resource "toolbox_external" "test" {
+			read    = true
+			program = [%[1]q]
+
+			query = {
+				marker = %[2]q
+			}
+		}
+	`, programPath, marker)
+
+	resource.UnitTest(t, resource.TestCase{
+		ProtoV6ProviderFactories: protoV6ProviderFactories(),
+		Steps: []resource.TestStep{
+			{
+				Config: config,
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttr("toolbox_external.test", "stage", "create"),
+				),
+			},
+			{
+				PreConfig: func() {
+					if err := os.Remove(marker); err != nil {
+						t.Fatal(err)
+					}
+				},
+				Config: config,
+				ConfigPlanChecks: resource.ConfigPlanChecks{
+					PreApply: []plancheck.PlanCheck{
+						plancheck.ExpectResourceAction("toolbox_external.test", plancheck.ResourceActionCreate),
+					},
+				},
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttr("toolbox_external.test", "stage", "create"),
+				),
+			},
+		},
+	})
+}
+
+func TestResource_PlanStage(t *testing.T) {
+	programPath, err := buildGoTestProgram()
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+
+	config := func(query string) string {
+		return fmt.Sprintf(`
+			resource "toolbox_external" "test" {
+				update  = true
+				plan    = true
+				program = [%[1]q]
+
+				query = {
+					%[2]s
+				}
+			}
+		`, programPath, query)
+	}
+
+	resource.UnitTest(t, resource.TestCase{
+		ProtoV6ProviderFactories: protoV6ProviderFactories(),
+		Steps: []resource.TestStep{
+			{
+				Config: config(`value = "one"`),
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttr("toolbox_external.test", "stage", "create"),
+					resource.TestCheckResourceAttr("toolbox_external.test", "result.query_value", "one"),
+				),
+			},
+			{
+				Config: config(`value = "two", replace = "true"`),
+				ConfigPlanChecks: resource.ConfigPlanChecks{
+					PreApply: []plancheck.PlanCheck{
+						plancheck.ExpectResourceAction("toolbox_external.test", plancheck.ResourceActionDestroyBeforeCreate),
+					},
+				},
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttr("toolbox_external.test", "stage", "create"),
+					resource.TestCheckResourceAttr("toolbox_external.test", "result.query_value", "two"),
+				),
+			},
+			{
+				Config: config(`value = "three"`),
+				ConfigPlanChecks: resource.ConfigPlanChecks{
+					PreApply: []plancheck.PlanCheck{
+						plancheck.ExpectResourceAction("toolbox_external.test", plancheck.ResourceActionUpdate),
+					},
+				},
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttr("toolbox_external.test", "stage", "update"),
+					resource.TestCheckResourceAttr("toolbox_external.test", "result.query_value", "three"),
+				),
+			},
+			{
+				// The predicted result must match the result of the update, or Terraform fails the apply
+				Config: config(`value = "four", predict = "true"`),
+				ConfigPlanChecks: resource.ConfigPlanChecks{
+					PreApply: []plancheck.PlanCheck{
+						plancheck.ExpectResourceAction("toolbox_external.test", plancheck.ResourceActionUpdate),
+						expectPlannedResult{"toolbox_external.test", "query_value", "four"},
+					},
+				},
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttr("toolbox_external.test", "stage", "update"),
+					resource.TestCheckResourceAttr("toolbox_external.test", "result.query_value", "four"),
+					resource.TestCheckResourceAttr("toolbox_external.test", "result.changed_keys", `["predict","value"]`),
+					resource.TestCheckNoResourceAttr("toolbox_external.test", "result.__warnings"),
+				),
+			},
+		},
+	})
+}
+
+func TestResource_PlanStage_PriorState(t *testing.T) {
+	programPath, err := buildGoTestProgram()
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+
+	config := func(value string) map[string]tftypes.Value {
+		return planStageConfig(programPath, map[string]string{"value": value, "other": "same"})
+	}
+	state := config("one")
+	state["id"] = tftypes.NewValue(tftypes.String, "-")
+	state["result"] = tftypes.NewValue(tftypes.Map{ElementType: tftypes.String}, map[string]tftypes.Value{})
+
+	// The plan stage is told which keys the update would change
+	resp := modifyPlan(t, config("two"), state)
+	if resp.Diagnostics.HasError() {
+		t.Fatalf("unexpected plan errors: %v", resp.Diagnostics)
+	}
+	expected := []string{"planned two", "changed [value]"}
+	if warnings := planWarnings(resp); fmt.Sprint(warnings) != fmt.Sprint(expected) {
+		t.Fatalf("plan warnings are %q; want %q", warnings, expected)
+	}
+
+	// A new resource has no prior state to compare with
+	resp = modifyPlan(t, config("two"), nil)
+	if resp.Diagnostics.HasError() {
+		t.Fatalf("unexpected plan errors: %v", resp.Diagnostics)
+	}
+	expected = []string{"planned two"}
+	if warnings := planWarnings(resp); fmt.Sprint(warnings) != fmt.Sprint(expected) {
+		t.Fatalf("plan warnings are %q; want %q", warnings, expected)
+	}
+}
+
+func TestResource_PlanStage_Prediction(t *testing.T) {
+	programPath, err := buildGoTestProgram()
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+
+	state := planStageConfig(programPath, map[string]string{"value": "one", "predict": "true"})
+	state["id"] = tftypes.NewValue(tftypes.String, "-")
+	state["result"] = tftypes.NewValue(tftypes.Map{ElementType: tftypes.String}, map[string]tftypes.Value{})
+
+	resp := modifyPlan(t, planStageConfig(programPath, map[string]string{"value": "two", "predict": "true"}), state)
+	if resp.Diagnostics.HasError() {
+		t.Fatalf("unexpected plan errors: %v", resp.Diagnostics)
+	}
+	expected := []string{"planned two", "changed [value]"}
+	if warnings := planWarnings(resp); fmt.Sprint(warnings) != fmt.Sprint(expected) {
+		t.Fatalf("plan warnings are %q; want %q", warnings, expected)
+	}
+
+	// The predicted result is planned, without the reserved keys
+	var plan externalResourceModelV0
+	if diags := resp.Plan.Get(context.Background(), &plan); diags.HasError() {
+		t.Fatalf("unexpected plan: %v", diags)
+	}
+	if plan.Result.IsUnknown() || plan.ResultJSON.IsUnknown() {
+		t.Fatalf("result is not predicted: %s", plan.Result)
+	}
+	result := plan.Result.Elements()
+	for key, value := range map[string]string{"query_value": `"two"`, "stage": `"update"`, "changed_keys": `"[\"value\"]"`} {
+		if result[key] == nil || result[key].String() != value {
+			t.Errorf("planned result.%s is %v; want %s", key, result[key], value)
+		}
+	}
+	for _, key := range []string{"__warnings", "__predicted"} {
+		if _, ok := result[key]; ok {
+			t.Errorf("planned result holds the reserved key %s", key)
+		}
+	}
+	typedResult := map[string]any{}
+	if err := json.Unmarshal([]byte(plan.ResultJSON.ValueString()), &typedResult); err != nil {
+		t.Fatalf("planned result_json is not valid JSON: %s", err)
+	}
+	if typedResult["query_value"] != "two" {
+		t.Errorf("planned result_json.query_value is %v; want two", typedResult["query_value"])
+	}
+}
+
+func TestResource_PlanStage_NotPredicted(t *testing.T) {
+	programPath, err := buildGoTestProgram()
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+
+	state := planStageConfig(programPath, map[string]string{"value": "one", "plan_as_create": "true"})
+	state["id"] = tftypes.NewValue(tftypes.String, "-")
+	state["result"] = tftypes.NewValue(tftypes.Map{ElementType: tftypes.String}, map[string]tftypes.Value{})
+
+	// The plan stage returns the same output as create, which does not predict the result
+	resp := modifyPlan(t, planStageConfig(programPath, map[string]string{"value": "two", "plan_as_create": "true"}), state)
+	if resp.Diagnostics.HasError() {
+		t.Fatalf("unexpected plan errors: %v", resp.Diagnostics)
+	}
+	var plan externalResourceModelV0
+	if diags := resp.Plan.Get(context.Background(), &plan); diags.HasError() {
+		t.Fatalf("unexpected plan: %v", diags)
+	}
+	if !plan.Result.IsNull() || !plan.SensitiveResult.IsNull() || !plan.ResultJSON.IsNull() {
+		t.Fatalf("result is predicted: %s %s", plan.Result, plan.ResultJSON)
+	}
+}
+
+func TestResource_PlanStage_WithoutUpdate(t *testing.T) {
+	programPath, err := buildGoTestProgram()
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+
+	resource.UnitTest(t, resource.TestCase{
+		ProtoV6ProviderFactories: protoV6ProviderFactories(),
+		Steps: []resource.TestStep{
+			{
+				Config: fmt.Sprintf(`
+					resource "toolbox_external" "test" {
+						update  = false
+						plan    = true
+						program = [%[1]q]
+					}
+				`, programPath),
+				PlanOnly:    true,
+				ExpectError: regexp.MustCompile(`Plan Stage Without Update Stage`),
+			},
+			{
+				// The update stage is disabled by default
+				Config: fmt.Sprintf(`
+					resource "toolbox_external" "test" {
+						plan    = true
+						program = [%[1]q]
+					}
+				`, programPath),
+				PlanOnly:    true,
+				ExpectError: regexp.MustCompile(`Plan Stage Without Update Stage`),
+			},
+		},
+	})
+}
+
+// planStageConfig returns the configuration of a resource running the program on create, update and plan with the
+// query.
+func planStageConfig(programPath string, query map[string]string) map[string]tftypes.Value {
+	queryValues := map[string]tftypes.Value{}
+	for key, value := range query {
+		queryValues[key] = tftypes.NewValue(tftypes.String, value)
+	}
+	return map[string]tftypes.Value{
+		"program": tftypes.NewValue(tftypes.List{ElementType: tftypes.String}, []tftypes.Value{
+			tftypes.NewValue(tftypes.String, programPath),
+		}),
+		"create": tftypes.NewValue(tftypes.Bool, true),
+		"read":   tftypes.NewValue(tftypes.Bool, false),
+		"update": tftypes.NewValue(tftypes.Bool, true),
+		"delete": tftypes.NewValue(tftypes.Bool, false),
+		"plan":   tftypes.NewValue(tftypes.Bool, true),
+		"query":  tftypes.NewValue(tftypes.Map{ElementType: tftypes.String}, queryValues),
+	}
+}
+
+// modifyPlan plans the resource from the prior state to the configuration, both given as the values of their
+// attributes with the others null, and a nil state for a new resource. The configuration is planned as is, so it
+// should set the stage flags.
+func modifyPlan(t *testing.T, config map[string]tftypes.Value, state map[string]tftypes.Value) fwresource.ModifyPlanResponse {
+	t.Helper()
+	ctx := context.Background()
+
+	r := &externalResource{}
+	var schemaResp fwresource.SchemaResponse
+	r.Schema(ctx, fwresource.SchemaRequest{}, &schemaResp)
+	objectType, ok := schemaResp.Schema.Type().TerraformType(ctx).(tftypes.Object)
+	if !ok {
+		t.Fatalf("unexpected schema type: %s", schemaResp.Schema.Type())
+	}
+	object := func(attributes map[string]tftypes.Value) tftypes.Value {
+		if attributes == nil {
+			return tftypes.NewValue(objectType, nil)
+		}
+		values := map[string]tftypes.Value{}
+		for name, attributeType := range objectType.AttributeTypes {
+			values[name] = tftypes.NewValue(attributeType, nil)
+			if value, ok := attributes[name]; ok {
+				values[name] = value
+			}
+		}
+		return tftypes.NewValue(objectType, values)
+	}
+
+	req := fwresource.ModifyPlanRequest{
+		Config: tfsdk.Config{Schema: schemaResp.Schema, Raw: object(config)},
+		Plan:   tfsdk.Plan{Schema: schemaResp.Schema, Raw: object(config)},
+		State:  tfsdk.State{Schema: schemaResp.Schema, Raw: object(state)},
+	}
+	resp := fwresource.ModifyPlanResponse{Plan: req.Plan}
+	r.ModifyPlan(ctx, req, &resp)
+	return resp
+}
+
+// planWarnings returns the details of the warnings reported by the plan stage.
+func planWarnings(resp fwresource.ModifyPlanResponse) []string {
+	var warnings []string
+	for _, warning := range resp.Diagnostics.Warnings() {
+		if warning.Summary() == "External Program Plan Warning" {
+			warnings = append(warnings, warning.Detail())
+		}
+	}
+	return warnings
+}
+
+// expectPlannedResult checks that the plan knows the value of a key of the result of the resource.
+type expectPlannedResult struct {
+	address string
+	key     string
+	value   string
+}
+
+func (e expectPlannedResult) CheckPlan(ctx context.Context, req plancheck.CheckPlanRequest, resp *plancheck.CheckPlanResponse) {
+	for _, change := range req.Plan.ResourceChanges {
+		if change.Address != e.address {
+			continue
+		}
+		after, _ := change.Change.After.(map[string]any)
+		result, ok := after["result"].(map[string]any)
+		if !ok {
+			resp.Error = fmt.Errorf("%s: result is not known in the plan", e.address)
+			return
+		}
+		if result[e.key] != e.value {
+			resp.Error = fmt.Errorf("%s: planned result.%s is %v; want %q", e.address, e.key, result[e.key], e.value)
+		}
+		return
+	}
+	resp.Error = fmt.Errorf("%s: not found in the plan", e.address)
+}
+
+func TestResource_OnFailure_Continue(t *testing.T) {
+	programPath, err := buildGoTestProgram()
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+
+	config := func(query string) string {
+		return fmt.Sprintf(`
+			resource "toolbox_external" "test" {
+				update     = true
+				on_failure = "continue"
+				program    = [%[1]q]
+
+				query = {
+					%[2]s
+				}
+			}
+		`, programPath, query)
+	}
+
+	resource.UnitTest(t, resource.TestCase{
+		ProtoV6ProviderFactories: protoV6ProviderFactories(),
+		Steps: []resource.TestStep{
+			{
+				Config: config(`partial_stage = "create"`),
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttr("toolbox_external.test", "stage", "create"),
+					resource.TestCheckResourceAttr("toolbox_external.test", "result.partial", "yes"),
+					resource.TestMatchResourceAttr("toolbox_external.test", "last_error", regexp.MustCompile(`I was asked to partially fail on create`)),
+				),
+			},
+			{
+				Config: config(`value = "one"`),
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttr("toolbox_external.test", "stage", "update"),
+					resource.TestCheckResourceAttr("toolbox_external.test", "result.query_value", "one"),
+					resource.TestCheckNoResourceAttr("toolbox_external.test", "last_error"),
+				),
+			},
+			{
+				// A failed update which output nothing keeps the previous result
+				Config: config(`value = "two", fail_stage = "update"`),
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttr("toolbox_external.test", "stage", "update"),
+					resource.TestCheckResourceAttr("toolbox_external.test", "result.query_value", "one"),
+					resource.TestMatchResourceAttr("toolbox_external.test", "result_json", regexp.MustCompile(`"query_value":"one"`)),
+					resource.TestMatchResourceAttr("toolbox_external.test", "last_error", regexp.MustCompile(`I was asked to fail on update`)),
+				),
+			},
+		},
+	})
+}
+
+func TestResource_OnFailure_Taint(t *testing.T) {
+	programPath, err := buildGoTestProgram()
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+
+	config := func(query string) string {
+		return fmt.Sprintf(`
+			resource "toolbox_external" "test" {
+				update     = true
+				on_failure = "taint"
+				program    = [%[1]q]
+
+				query = {
+					%[2]s
+				}
+			}
+		`, programPath, query)
+	}
+
+	resource.UnitTest(t, resource.TestCase{
+		ProtoV6ProviderFactories: protoV6ProviderFactories(),
+		Steps: []resource.TestStep{
+			{
+				Config: config(`value = "one"`),
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttr("toolbox_external.test", "stage", "create"),
+					resource.TestCheckNoResourceAttr("toolbox_external.test", "last_error"),
+				),
+			},
+			{
+				Config:      config(`value = "two", partial_stage = "update"`),
+				ExpectError: regexp.MustCompile(`I was asked to partially fail on update`),
+			},
+			{
+				// The resource saved after the failure is replaced, the create stage does not fail
+				Config: config(`value = "two", partial_stage = "update"`),
+				ConfigPlanChecks: resource.ConfigPlanChecks{
+					PreApply: []plancheck.PlanCheck{
+						plancheck.ExpectResourceAction("toolbox_external.test", plancheck.ResourceActionDestroyBeforeCreate),
+					},
+				},
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttr("toolbox_external.test", "stage", "create"),
+					resource.TestCheckResourceAttr("toolbox_external.test", "result.query_value", "two"),
+					resource.TestCheckNoResourceAttr("toolbox_external.test", "last_error"),
+				),
+			},
+		},
+	})
+}
+
+func TestResource_Rollback(t *testing.T) {
+	programPath, err := buildGoTestProgram()
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+
+	marker := filepath.Join(t.TempDir(), "marker")
+	config := func(query string) string {
+		return fmt.Sprintf(`
+			resource "toolbox_external" "test" {
+				update           = true
+				program          = [%[1]q]
+				rollback_program = [%[1]q]
+
+				query = {
+					%[2]s
+				}
+			}
+		`, programPath, query)
+	}
+
+	resource.UnitTest(t, resource.TestCase{
+		ProtoV6ProviderFactories: protoV6ProviderFactories(),
+		Steps: []resource.TestStep{
+			{
+				Config: config(`value = "one"`),
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttr("toolbox_external.test", "stage", "create"),
+				),
+			},
+			{
+				Config:      config(fmt.Sprintf(`value = "two", fail_stage = "update", rollback_marker = %q`, marker)),
+				ExpectError: regexp.MustCompile(`I was asked to fail on update`),
+			},
+			{
+				PreConfig: func() {
+					content, err := os.ReadFile(marker)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if expected := "rolled back two to one after: I was asked to fail on update\n"; string(content) != expected {
+						t.Fatalf("expected the rollback marker to contain %q, got %q", expected, content)
+					}
+				},
+				Config: config(`value = "one"`),
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttr("toolbox_external.test", "result.query_value", "one"),
+				),
+			},
+		},
+	})
+}
+
+func TestResource_Rollback_Continue(t *testing.T) {
+	programPath, err := buildGoTestProgram()
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+
+	config := func(query string) string {
+		return fmt.Sprintf(`
+			resource "toolbox_external" "test" {
+				update           = true
+				on_failure       = "continue"
+				program          = [%[1]q]
+				rollback_program = [%[1]q]
+
+				query = {
+					%[2]s
+				}
+			}
+		`, programPath, query)
+	}
+	// The first run of the update fails and is rolled back, the next one succeeds
+	failOnce := config(fmt.Sprintf(`value = "two", attempts_file = %q, fail_attempts = "1"`, filepath.Join(t.TempDir(), "attempts")))
+
+	resource.UnitTest(t, resource.TestCase{
+		ProtoV6ProviderFactories: protoV6ProviderFactories(),
+		Steps: []resource.TestStep{
+			{
+				Config: config(`value = "one"`),
+			},
+			{
+				// The rolled back update keeps the previous result and is planned again
+				Config: failOnce,
+				ConfigPlanChecks: resource.ConfigPlanChecks{
+					PostApplyPostRefresh: []plancheck.PlanCheck{
+						plancheck.ExpectResourceAction("toolbox_external.test", plancheck.ResourceActionUpdate),
+					},
+				},
+				ExpectNonEmptyPlan: true,
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttr("toolbox_external.test", "result.query_value", "one"),
+					resource.TestMatchResourceAttr("toolbox_external.test", "last_error", regexp.MustCompile(`transient failure on attempt 1`)),
+				),
+			},
+			{
+				// The update applied again is given the query restored by the rollback as the prior one
+				Config: failOnce,
+				ConfigPlanChecks: resource.ConfigPlanChecks{
+					PreApply: []plancheck.PlanCheck{
+						plancheck.ExpectResourceAction("toolbox_external.test", plancheck.ResourceActionUpdate),
+					},
+				},
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttr("toolbox_external.test", "result.query_value", "two"),
+					resource.TestCheckResourceAttr("toolbox_external.test", "result.attempt", "2"),
+					resource.TestMatchResourceAttr("toolbox_external.test", "result.changed_keys", regexp.MustCompile(`"value"`)),
+					resource.TestCheckNoResourceAttr("toolbox_external.test", "last_error"),
+				),
+			},
+		},
+	})
+}
+
+func TestResource_Rollback_Missing(t *testing.T) {
+	programPath, err := buildGoTestProgram()
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+
+	config := func(rollbackProgram string) string {
+		return fmt.Sprintf(`
+			resource "toolbox_external" "test" {
+				update           = true
+				program          = [%[1]q]
+				rollback_program = %[2]s
+			}
+		`, programPath, rollbackProgram)
+	}
+
+	resource.UnitTest(t, resource.TestCase{
+		ProtoV6ProviderFactories: protoV6ProviderFactories(),
+		Steps: []resource.TestStep{
+			{
+				Config:      config(`[]`),
+				PlanOnly:    true,
+				ExpectError: regexp.MustCompile(`list must contain at least 1 elements`),
+			},
+			{
+				Config:      config(`["", ""]`),
+				PlanOnly:    true,
+				ExpectError: regexp.MustCompile(`External Program Missing`),
+			},
+		},
+	})
+}
+
+func TestResource_Rollback_Failed(t *testing.T) {
+	programPath, err := buildGoTestProgram()
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+
+	config := func(query string) string {
+		return fmt.Sprintf(`
+			resource "toolbox_external" "test" {
+				update           = true
+				program          = [%[1]q]
+				rollback_program = [%[1]q]
+
+				query = {
+					%[2]s
+				}
+			}
+		`, programPath, query)
+	}
+
+	resource.UnitTest(t, resource.TestCase{
+		ProtoV6ProviderFactories: protoV6ProviderFactories(),
+		Steps: []resource.TestStep{
+			{
+				Config: config(`value = "one"`),
+			},
+			{
+				Config:      config(`value = "two", fail_stage = "update", fail_rollback = "true"`),
+				ExpectError: regexp.MustCompile(`(?s)External Program Rollback Failed.*I was asked to fail the rollback of two`),
+			},
+		},
+	})
+}
+
+func TestResource_Delete_WarnAndForget(t *testing.T) {
+	programPath, err := buildGoTestProgram()
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+
+	config := fmt.Sprintf(`
+		resource "toolbox_external" "test" {
+			delete            = true
+			on_delete_failure = "warn_and_forget"
+			program           = [%[1]q]
+
+			query = {
+				fail_stage = "delete"
+			}
+		}
+	`, programPath)
+
+	resource.UnitTest(t, resource.TestCase{
+		ProtoV6ProviderFactories: protoV6ProviderFactories(),
+		Steps: []resource.TestStep{
+			{
+				Config: config,
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttr("toolbox_external.test", "stage", "create"),
+				),
+			},
+			{
+				// Destroying the resource succeeds although the delete program fails
+				Config:  config,
+				Destroy: true,
+			},
+		},
+	})
+}
+
 func TestResource_Query_NullAndEmptyValue(t *testing.T) {
 	programPath, err := buildGoTestProgram()
 	if err != nil {
@@ -539,6 +2482,84 @@ func TestResource_Bash_File(t *testing.T) {
 	})
 }
 
+func TestResource_Import(t *testing.T) {
+	programPath, err := buildGoTestProgram()
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+
+	importID, err := json.Marshal(externalImportID{
+		Program: []string{programPath, "imported"},
+		Query:   map[string]string{"value": "pizza"},
+	})
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+
+	resource.UnitTest(t, resource.TestCase{
+		ProtoV6ProviderFactories: protoV6ProviderFactories(),
+		Steps: []resource.TestStep{
+			{
+				Config: fmt.Sprintf(testResourceConfig_basic, programPath),
+			},
+			{
+				Config:        fmt.Sprintf(testResourceConfig_basic, programPath),
+				ResourceName:  "toolbox_external.test",
+				ImportState:   true,
+				ImportStateId: string(importID),
+				ImportStateCheck: func(states []*terraform.InstanceState) error {
+					if len(states) != 1 {
+						return fmt.Errorf("expected 1 imported state, got %d", len(states))
+					}
+
+					attributes := states[0].Attributes
+					expected := map[string]string{
+						"id":                 "-",
+						"stage":              "import",
+						"query.value":        "pizza",
+						"result.stage":       "import",
+						"result.argument":    "imported",
+						"result.query_value": "pizza",
+					}
+					for key, value := range expected {
+						if attributes[key] != value {
+							return fmt.Errorf("%s is %q; want %q", key, attributes[key], value)
+						}
+					}
+
+					return nil
+				},
+			},
+		},
+	})
+}
+
+func TestResource_Import_InvalidID(t *testing.T) {
+	programPath, err := buildGoTestProgram()
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+
+	resource.UnitTest(t, resource.TestCase{
+		ProtoV6ProviderFactories: protoV6ProviderFactories(),
+		Steps: []resource.TestStep{
+			{
+				Config: fmt.Sprintf(testResourceConfig_basic, programPath),
+			},
+			{
+				Config:        fmt.Sprintf(testResourceConfig_basic, programPath),
+				ResourceName:  "toolbox_external.test",
+				ImportState:   true,
+				ImportStateId: "not-json",
+				ExpectError:   regexp.MustCompile(`Invalid Import ID`),
+			},
+		},
+	})
+}
+
 func TestResource_upgrade(t *testing.T) {
 	programPath, err := buildGoTestProgram()
 	if err != nil {
@@ -648,6 +2669,71 @@ func buildGoTestProgram() (string, error) {
 	return programPath, nil
 }
 
+func TestResource_Timeout(t *testing.T) {
+	resource.UnitTest(t, resource.TestCase{
+		ProtoV6ProviderFactories: protoV6ProviderFactories(),
+		Steps: []resource.TestStep{
+			{
+				Config: `
+					resource "toolbox_external" "test" {
+						program = ["sleep", "60"]
+
+						timeouts {
+							create       = "1s"
+							grace_period = "1s"
+						}
+					}
+				`,
+				ExpectError: regexp.MustCompile(`(?s)External Program Timed Out.*create\s+stage`),
+			},
+		},
+	})
+}
+
+func TestResource_BackgroundProcess(t *testing.T) {
+	resource.UnitTest(t, resource.TestCase{
+		ProtoV6ProviderFactories: protoV6ProviderFactories(),
+		Steps: []resource.TestStep{
+			{
+				// The background process keeps the output of the program open long after it exited
+				Config: `
+					resource "toolbox_external" "test" {
+						program = ["bash", "-c", "sleep 60 & echo '{\"done\":\"yes\"}'"]
+
+						timeouts {
+							grace_period = "1s"
+						}
+					}
+				`,
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttr("toolbox_external.test", "result.done", "yes"),
+				),
+			},
+		},
+	})
+}
+
+func TestResource_Timeout_Invalid(t *testing.T) {
+	resource.UnitTest(t, resource.TestCase{
+		ProtoV6ProviderFactories: protoV6ProviderFactories(),
+		Steps: []resource.TestStep{
+			{
+				Config: `
+					resource "toolbox_external" "test" {
+						program = ["true"]
+
+						timeouts {
+							create = "soon"
+						}
+					}
+				`,
+				PlanOnly:    true,
+				ExpectError: regexp.MustCompile(`Invalid Duration`),
+			},
+		},
+	})
+}
+
 // Reference: https://github.com/hashicorp/terraform-provider-external/issues/145
 func TestResource_20MinuteTimeout(t *testing.T) {
 	if os.Getenv(EnvTfAccExternalTimeoutTest) == "" {
@@ -0,0 +1,89 @@
+package provider
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Defaults of the retry block.
+const (
+	defaultRetryMaxAttempts    = 3
+	defaultRetryInitialBackoff = time.Second
+	defaultRetryMaxBackoff     = 30 * time.Second
+)
+
+// retryStages are the stages which can be retried, all of them are retried by default.
+var retryStages = []string{"create", "read", "update", "delete", "plan", "import"}
+
+// retryPolicy decides whether a failed run of the program is run again and how long to wait before it.
+type retryPolicy struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	ExitCodes      map[int]bool
+	StderrPatterns []*regexp.Regexp
+}
+
+// noRetry runs the program a single time.
+var noRetry = retryPolicy{MaxAttempts: 1}
+
+// retryable returns whether the failure of the run is worth another attempt. Timed out runs are not retried. When
+// neither exit codes nor stderr patterns are configured, every non-zero exit is retried.
+func (p retryPolicy) retryable(run externalRun, secrets []string) bool {
+	var exitErr *exec.ExitError
+	if run.TimedOut || !errors.As(run.Err, &exitErr) {
+		return false
+	}
+	if len(p.ExitCodes) == 0 && len(p.StderrPatterns) == 0 {
+		return true
+	}
+	if p.ExitCodes[exitErr.ExitCode()] {
+		return true
+	}
+	stderr := run.Stderr.Text(maxStderrBytes, secrets)
+	for _, pattern := range p.StderrPatterns {
+		if pattern.MatchString(stderr) {
+			return true
+		}
+	}
+	return false
+}
+
+// backoff returns how long to wait after the given attempt failed, doubling from the initial backoff up to the
+// maximum backoff.
+func (p retryPolicy) backoff(attempt int) time.Duration {
+	backoff := p.InitialBackoff
+	for i := 1; i < attempt && backoff < p.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > p.MaxBackoff {
+		return p.MaxBackoff
+	}
+	return backoff
+}
+
+// summarizeAttempts describes every failed run of the program for the final diagnostic.
+func summarizeAttempts(runs []externalRun, secrets []string) string {
+	if len(runs) < 2 {
+		return ""
+	}
+	var summary strings.Builder
+	summary.WriteString(fmt.Sprintf("\n\nThe program was run %d times:", len(runs)))
+	for _, run := range runs {
+		summary.WriteString(fmt.Sprintf("\n- attempt %d after %s: %s", run.Attempt, run.Duration.Round(time.Millisecond), run.Err))
+		if line := lastLine(run.Stderr.Text(maxStderrBytes, secrets)); line != "" {
+			summary.WriteString(fmt.Sprintf(": %s", line))
+		}
+	}
+	return summary.String()
+}
+
+// lastLine returns the last non-empty line of text.
+func lastLine(text string) string {
+	lines := strings.Split(strings.TrimSpace(text), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
@@ -0,0 +1,160 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/terraform-plugin-framework/diag"
+	"github.com/hashicorp/terraform-plugin-framework/path"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+)
+
+// rolledBackStateKey is the key of the private state holding the inputs of the prior state when a failed update was
+// rolled back and the resource kept with on_failure, so that the next plan applies the update again from them.
+const rolledBackStateKey = "rolled_back"
+
+// rollbackInput is the JSON object passed to the rollback program on stdin.
+type rollbackInput struct {
+	Stage string `json:"stage"`
+	// Query is the JSON object the failed update program received.
+	Query     json.RawMessage `json:"query"`
+	OldResult json.RawMessage `json:"old_result"`
+	Error     string          `json:"error"`
+	Stdout    string          `json:"stdout"`
+	Stderr    string          `json:"stderr"`
+	ExitCode  int             `json:"exit_code"`
+}
+
+// rolledBackInputs are the inputs of the prior state which the program is given, as the rollback restored them.
+type rolledBackInputs struct {
+	Query          map[string]*string `json:"query"`
+	SensitiveQuery map[string]*string `json:"sensitive_query"`
+	WorkingDir     *string            `json:"working_dir"`
+}
+
+// isRolledBack returns whether the private state at rolledBackStateKey records a rolled back update.
+func isRolledBack(data []byte) bool {
+	return len(data) > 0 && string(data) != "null"
+}
+
+// rolledBackInputs returns the inputs of the prior state to store at rolledBackStateKey.
+func (m externalResourceModelV0) rolledBackInputs(ctx context.Context) ([]byte, diag.Diagnostics) {
+	var diags diag.Diagnostics
+	inputs := rolledBackInputs{WorkingDir: m.WorkingDir.ValueStringPointer()}
+	diags.Append(m.Query.ElementsAs(ctx, &inputs.Query, false)...)
+	diags.Append(m.SensitiveQuery.ElementsAs(ctx, &inputs.SensitiveQuery, false)...)
+	if diags.HasError() {
+		return nil, diags
+	}
+	// Decoded from the state, so it can always be encoded
+	data, _ := json.Marshal(inputs)
+	return data, diags
+}
+
+// restoreInputs replaces the inputs of the prior state with the ones stored at rolledBackStateKey, when the last
+// update was rolled back.
+func (m *externalResourceModelV0) restoreInputs(ctx context.Context, data []byte) diag.Diagnostics {
+	var diags diag.Diagnostics
+	if !isRolledBack(data) {
+		return diags
+	}
+	var inputs rolledBackInputs
+	if err := json.Unmarshal(data, &inputs); err != nil {
+		diags.AddError(
+			"Private State Handling Failed",
+			"The resource received an unexpected error while attempting to read the inputs restored by the last rollback. "+
+				"This is always a bug in the external provider code and should be reported to the provider developers."+
+				fmt.Sprintf("\n\nError: %s", err),
+		)
+		return diags
+	}
+	query, mapDiags := types.MapValueFrom(ctx, types.StringType, inputs.Query)
+	diags.Append(mapDiags...)
+	sensitiveQuery, mapDiags := types.MapValueFrom(ctx, types.StringType, inputs.SensitiveQuery)
+	diags.Append(mapDiags...)
+	if diags.HasError() {
+		return diags
+	}
+	m.Query, m.SensitiveQuery, m.WorkingDir = query, sensitiveQuery, types.StringPointerValue(inputs.WorkingDir)
+	return diags
+}
+
+// rollback runs the rollback program after the update program failed, with the same working directory,
+// environment and time limit. It returns a warning when the rollback succeeded and an error when it failed. The
+// secrets of the failed run, including the values it returned for sensitive keys, are redacted from both.
+func (m externalResourceModelV0) rollback(ctx context.Context, failed externalRun, errors diag.Diagnostics, secrets []string) diag.Diagnostics {
+	var diags diag.Diagnostics
+	programPath := path.Root("rollback_program")
+
+	filteredProgram, _ := programArgs(m.RollbackProgram)
+	if len(filteredProgram) == 0 {
+		diags.AddAttributeError(programPath,
+			"External Program Missing",
+			"The resource was configured without a rollback program to execute. Verify the configuration contains at least one non-empty value.",
+		)
+		return diags
+	}
+
+	// The previous result is passed as the update program received it, following the query encoding
+	var query map[string]json.RawMessage
+	if err := json.Unmarshal(failed.Command.Stdin, &query); err != nil {
+		diags.AddAttributeError(programPath,
+			"Query Handling Failed",
+			"The resource received an unexpected error while attempting to parse the query of the update program. "+
+				"This is always a bug in the external provider code and should be reported to the provider developers."+
+				fmt.Sprintf("\n\nError: %s", err),
+		)
+		return diags
+	}
+	exitCode := -1
+	if failed.Cmd.ProcessState != nil {
+		exitCode = failed.Cmd.ProcessState.ExitCode()
+	}
+	input, err := json.Marshal(rollbackInput{
+		Stage:     "rollback",
+		Query:     failed.Command.Stdin,
+		OldResult: query["old_result"],
+		Error:     errorSummary(errors),
+		Stdout:    string(failed.Stdout),
+		Stderr:    failed.Stderr.Text(maxStderrBytes, nil),
+		ExitCode:  exitCode,
+	})
+	if err != nil {
+		diags.AddAttributeError(programPath,
+			"Query Handling Failed",
+			"The resource received an unexpected error while attempting to build the input of the rollback program. "+
+				"This is always a bug in the external provider code and should be reported to the provider developers."+
+				fmt.Sprintf("\n\nError: %s", err),
+		)
+		return diags
+	}
+
+	command := failed.Command
+	command.Program = filteredProgram
+	command.Stdin = input
+	command.Stage = "rollback"
+	command.Secrets = secrets
+	run := command.run(ctx, 1)
+
+	if run.Err != nil {
+		diags.AddAttributeError(programPath,
+			"External Program Rollback Failed",
+			"The update program failed and so did the rollback program, the changes made by the update program "+
+				"may not have been undone."+
+				fmt.Sprintf("\n\nProgram: %s", run.Cmd.Path)+
+				fmt.Sprintf("\nError Message: %s", run.Stderr.Text(maxStderrBytes, secrets))+
+				fmt.Sprintf("\nState: %s", run.Err),
+		)
+		return diags
+	}
+
+	detail := "The update program failed and the rollback program completed successfully." +
+		fmt.Sprintf("\n\nProgram: %s", run.Cmd.Path)
+	if output := strings.TrimSpace(string(run.Stdout)); output != "" {
+		detail += fmt.Sprintf("\nOutput: %s", redact(output, secrets))
+	}
+	diags.AddAttributeWarning(programPath, "External Program Rolled Back", detail)
+	return diags
+}
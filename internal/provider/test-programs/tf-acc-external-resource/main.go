@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"time"
 )
 
 // This is a minimal implementation of the external resource protocol
@@ -26,27 +27,182 @@ func main() {
 		panic(err)
 	}
 
+	// The rollback program is given the query of the failed update, it records what it undid in the marker file
+	if query["stage"] == "rollback" {
+		attempted, _ := query["query"].(map[string]any)
+		oldResult, _ := query["old_result"].(map[string]any)
+		if attempted["fail_rollback"] == "true" {
+			fmt.Fprintf(os.Stderr, "I was asked to fail the rollback of %v\n", attempted["value"])
+			os.Exit(1)
+		}
+		if marker, ok := attempted["rollback_marker"].(string); ok {
+			content := fmt.Sprintf("rolled back %v to %v after: %v", attempted["value"], oldResult["query_value"], query["stderr"])
+			if err := os.WriteFile(marker, []byte(content), 0o600); err != nil {
+				panic(err)
+			}
+		}
+		os.Exit(0)
+	}
+
 	if query["fail"] == "true" {
 		fmt.Fprintf(os.Stderr, "I was asked to fail\n")
 		os.Exit(1)
 	}
 
+	if stage, ok := query["fail_stage"]; ok && stage == query["stage"] {
+		fmt.Fprintf(os.Stderr, "I was asked to fail on %s\n", stage)
+		os.Exit(1)
+	}
+
+	// A partial failure outputs what was done before the program failed
+	if stage, ok := query["partial_stage"]; ok && stage == query["stage"] {
+		os.Stdout.WriteString(`{"partial":"yes"}`)
+		fmt.Fprintf(os.Stderr, "I was asked to partially fail on %s\n", stage)
+		os.Exit(1)
+	}
+
+	// The attempts file counts the runs of the program so it can fail transiently before succeeding
+	attempt := 0
+	if attemptsFile, ok := query["attempts_file"].(string); ok {
+		content, _ := os.ReadFile(attemptsFile)
+		attempt = len(content) + 1
+		if err := os.WriteFile(attemptsFile, append(content, '.'), 0o600); err != nil {
+			panic(err)
+		}
+		if failAttempts, ok := query["fail_attempts"].(float64); ok && attempt <= int(failAttempts) {
+			fmt.Fprintf(os.Stderr, "transient failure on attempt %d\n", attempt)
+			os.Exit(1)
+		}
+	}
+
+	if message, ok := query["stderr"].(string); ok {
+		fmt.Fprintln(os.Stderr, message)
+	}
+
+	// The plan stage reports what the change would do, and predicts the result of the stage which follows when
+	// asked to. A program ignoring the stage returns the same output on plan as on create.
+	var planned map[string]any
+	if query["stage"] == "plan" && query["plan_as_create"] != true {
+		toolbox, _ := query["__toolbox"].(map[string]any)
+		warnings := []string{fmt.Sprintf("planned %v", query["value"])}
+		if toolbox["changed_keys"] != nil {
+			warnings = append(warnings, fmt.Sprintf("changed %v", toolbox["changed_keys"]))
+		}
+		planned = map[string]any{
+			"__warnings": warnings,
+		}
+		if query["replace"] == true {
+			planned["__requires_replace"] = true
+		}
+		if query["predict"] != true {
+			planBytes, err := json.Marshal(planned)
+			if err != nil {
+				panic(err)
+			}
+			os.Stdout.Write(planBytes)
+			os.Exit(0)
+		}
+		planned["__predicted"] = true
+		query["stage"] = "create"
+		if _, ok := toolbox["old_query"]; ok {
+			query["stage"] = "update"
+		}
+	}
+
 	var result = map[string]any{
 		"result":      "yes",
 		"query_value": query["value"],
 	}
 
+	if attempt > 0 {
+		result["attempt"] = attempt
+	}
+
+	// The private data is kept between stages, the result reports what the previous stage stored
+	if value, ok := query["private"]; ok {
+		result["__private"] = map[string]any{"value": value}
+		toolbox, _ := query["__toolbox"].(map[string]any)
+		if oldPrivate, ok := toolbox["old_private"].(map[string]any); ok && oldPrivate["value"] != nil {
+			result["old_private_value"] = oldPrivate["value"]
+		}
+	}
+
+	if diagnostics, ok := query["diagnostics"]; ok {
+		result["__diagnostics"] = diagnostics
+	}
+
 	if len(os.Args) >= 2 {
 		result["argument"] = os.Args[1]
 	}
 
+	if name, ok := query["env"].(string); ok {
+		result["env_value"] = os.Getenv(name)
+	}
+
+	if query["print_working_dir"] == "true" {
+		workingDir, err := os.Getwd()
+		if err != nil {
+			panic(err)
+		}
+		result["working_dir"] = workingDir
+	}
+
+	// The running directory holds a file for every program running, which reports how many run at once
+	if runningDir, ok := query["running_dir"].(string); ok {
+		running, err := os.CreateTemp(runningDir, "running")
+		if err != nil {
+			panic(err)
+		}
+		running.Close()
+		time.Sleep(500 * time.Millisecond)
+		entries, err := os.ReadDir(runningDir)
+		if err != nil {
+			panic(err)
+		}
+		result["running"] = len(entries)
+		if err := os.Remove(running.Name()); err != nil {
+			panic(err)
+		}
+	}
+
+	if id, ok := query["new_id"].(string); ok && query["stage"] == "create" {
+		result["id"] = id
+	}
+
+	// The marker file stands in for an object managed by the program which can disappear outside of Terraform
+	if marker, ok := query["marker"].(string); ok {
+		switch query["stage"] {
+		case "create":
+			if err := os.WriteFile(marker, nil, 0o600); err != nil {
+				panic(err)
+			}
+		case "read":
+			if _, err := os.Stat(marker); err != nil {
+				result["__exists"] = false
+			}
+		}
+	}
+
 	for queryKey, queryValue := range query {
-		if queryKey == "old_result" {
+		if queryKey == "old_result" || queryKey == "__toolbox" {
 			continue
 		}
 		result[queryKey] = queryValue
 	}
 
+	// The metadata set by the provider is echoed under its own keys
+	if toolbox, ok := query["__toolbox"].(map[string]any); ok {
+		for toolboxKey, toolboxValue := range toolbox {
+			if toolboxKey != "old_private" {
+				result[toolboxKey] = toolboxValue
+			}
+		}
+	}
+
+	for plannedKey, plannedValue := range planned {
+		result[plannedKey] = plannedValue
+	}
+
 	resultBytes, err := json.Marshal(result)
 	if err != nil {
 		panic(err)